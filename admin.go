@@ -0,0 +1,188 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/TheAlyxGreen/firefly"
+)
+
+// maxTestEventBytes caps the body accepted by /match/test
+const maxTestEventBytes = 1 << 20
+
+// requireAdminToken guards an admin endpoint with the configured adminToken, sent as
+// "Authorization: Bearer <token>". Admin endpoints are disabled when no token is configured.
+func requireAdminToken(token string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if token == "" {
+			http.Error(w, "admin endpoints are disabled; set adminToken to enable them", http.StatusForbidden)
+			return
+		}
+		given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			http.Error(w, "invalid admin token", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// requireStreamToken guards a streaming endpoint with the configured wsAuthToken, sent as
+// "Authorization: Bearer <token>" or, for browsers that can't set headers on websockets and
+// EventSource, as ?token=. Endpoints are open when no token is configured.
+func requireStreamToken(token string, next http.HandlerFunc) http.HandlerFunc {
+	if token == "" {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		given := r.URL.Query().Get("token")
+		if auth := r.Header.Get("Authorization"); auth != "" {
+			given = strings.TrimPrefix(auth, "Bearer ")
+		}
+		if subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			http.Error(w, "invalid or missing token", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// MatchTestResult is the JSON body returned by /match/test
+type MatchTestResult struct {
+	MatchedRules     []string         `json:"matchedRules"`
+	MatchedGroups    []string         `json:"matchedGroups,omitempty"`
+	Collection       string           `json:"collection"`
+	AuthorDID        string           `json:"authorDid"`
+	TargetUserDID    string           `json:"targetUserDid,omitempty"`
+	GloballyFiltered bool             `json:"globallyFiltered,omitempty"` // Dropped by ignoreCollections or globalBlockDIDs/globalAllowDIDs before rules ran
+	Rules            []RuleTestResult `json:"rules,omitempty"`            // Per-rule results, with ?details=true
+}
+
+// RuleTestResult is one rule's outcome for a tested event
+type RuleTestResult struct {
+	Name        string       `json:"name"`
+	Group       string       `json:"group,omitempty"`
+	Matched     bool         `json:"matched"` // The rule's own result; a grouped rule also needs its group to match
+	FailedStage string       `json:"failedStage,omitempty"`
+	Details     *MatchDetail `json:"details,omitempty"` // Which conditions triggered a match
+
+	Captures map[string]string `json:"captures,omitempty"` // Named groups captured by a captureGroups rule
+}
+
+// matchTestHandler evaluates a posted Jetstream event against the rules exactly as a worker would
+func matchTestHandler(client *firefly.Firefly, rules *RuleTable, filter *GlobalFilter, profiles *ProfileCache, subjects *SubjectCache, normalizer TextNormalizer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "POST a Jetstream event", http.StatusMethodNotAllowed)
+			return
+		}
+		body, err := io.ReadAll(io.LimitReader(r.Body, maxTestEventBytes))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		event, err := ParseJetstreamEvent(client, body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		info := DescribeEvent(event)
+		info.Profiles = profiles
+		info.Subjects = subjects
+		info.Text = normalizer.Apply(info.Text)
+		result := MatchTestResult{
+			MatchedRules:  []string{},
+			Collection:    info.Collection,
+			AuthorDID:     info.AuthorDID,
+			TargetUserDID: info.TargetUserDID,
+		}
+		details := r.URL.Query().Get("details") == "true"
+
+		if !filter.Permits(info) {
+			result.GloballyFiltered = true
+		} else {
+			var report func(*CompiledRuleSet, RuleResult)
+			if details {
+				report = func(rule *CompiledRuleSet, ruleResult RuleResult) {
+					result.Rules = append(result.Rules, RuleTestResult{
+						Name:        rule.Name,
+						Group:       rule.Group,
+						Matched:     ruleResult.Matched,
+						FailedStage: ruleResult.FailedStage,
+						Details:     ruleResult.Details,
+						Captures:    ruleResult.Captures,
+					})
+				}
+			}
+			matches, groups := MatchRules(rules.Load(), info, details, report)
+			for _, m := range matches {
+				result.MatchedRules = append(result.MatchedRules, m.Rule.Name)
+			}
+			result.MatchedGroups = groups
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(result)
+	}
+}
+
+// reloadRuleHandler reloads the rule named in the path and returns its new description, or
+// the reason it was rejected. A rejected reload leaves the running rule as it was.
+func reloadRuleHandler(names []string, reload func(name string) (*CompiledRuleSet, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "POST to reload the rule", http.StatusMethodNotAllowed)
+			return
+		}
+		name := r.PathValue("rule")
+		if !slices.Contains(names, name) {
+			http.Error(w, "unknown rule", http.StatusNotFound)
+			return
+		}
+		rule, err := reload(name)
+		if err != nil {
+			slog.Warn("Rule reload rejected, keeping the running rule", "rule", name, "error", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(rule.Info())
+	}
+}
+
+// testBroadcastHandler sends a posted BroadcastMessage to every connected client that wants
+// it, exactly as if a rule had matched. Other sinks and /recent don't see it.
+func testBroadcastHandler(hub *Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "POST a broadcast message", http.StatusMethodNotAllowed)
+			return
+		}
+		dec := json.NewDecoder(io.LimitReader(r.Body, maxTestEventBytes))
+		dec.DisallowUnknownFields()
+		var msg BroadcastMessage
+		if err := dec.Decode(&msg); err != nil {
+			http.Error(w, "invalid broadcast message: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if msg.Event == nil {
+			http.Error(w, "invalid broadcast message: event is required", http.StatusBadRequest)
+			return
+		}
+		if len(msg.MatchedRules) == 0 {
+			http.Error(w, "invalid broadcast message: matchedRules must name at least one rule", http.StatusBadRequest)
+			return
+		}
+		if msg.SchemaVersion == 0 {
+			msg.SchemaVersion = SchemaVersion
+		}
+		hub.Send(msg)
+		w.WriteHeader(http.StatusAccepted)
+	}
+}
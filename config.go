@@ -2,41 +2,783 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
+	"net"
 	"os"
+	"reflect"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
 )
 
 type RuleSet struct {
 	Name        string   `json:"name"`
 	Collections []string `json:"collections"`
+	Operations  []string `json:"operations,omitempty"` // create, update, delete; events without an operation bypass the check
 	TextRegexes []string `json:"textRegexes"`
 	UrlRegexes  []string `json:"urlRegexes"`
+
+	// External link card title and description patterns; posts without a link card never match
+	ExternalTitleRegexes []string `json:"externalTitleRegexes,omitempty"`
+	ExternalDescRegexes  []string `json:"externalDescRegexes,omitempty"`
+
+	// SubjectTextRegexes match the text of the post a repost or quote points at, fetched in the
+	// background; events are matched without it until it's cached
+	SubjectTextRegexes []string `json:"subjectTextRegexes,omitempty"`
+
+	// CaptureGroups adds the named groups of the matching text regex to the broadcast's "captures"
+	CaptureGroups bool `json:"captureGroups,omitempty"`
+
 	Authors     []string `json:"authors"`
 	TargetUsers []string `json:"targetUsers"`
-	EmbedTypes  []string `json:"embedTypes"`
-	Langs       []string `json:"langs"`
-	IsReply     *bool    `json:"isReply,omitempty"`
+
+	// List files with one DID (or, for targets, handle) per line, added to Authors and TargetUsers.
+	// Each file is loaded once and shared by every rule that names it.
+	AuthorsFile     string `json:"authorsFile,omitempty"`
+	TargetUsersFile string `json:"targetUsersFile,omitempty"`
+
+	// TargetInvolved matches events aimed at any of these DIDs or handles in any way: as the reply
+	// parent's author, a mention, the liked or reposted record's author, or the quoted post's author
+	TargetInvolved []string `json:"targetInvolved,omitempty"`
+
+	// QuoteTargets matches quote posts of posts by any of these DIDs or handles; other events never match
+	QuoteTargets []string `json:"quoteTargets,omitempty"`
+
+	// TargetCollections matches likes and reposts by the collection of the record they point at
+	// (e.g. app.bsky.feed.generator); other events never match
+	TargetCollections []string `json:"targetCollections,omitempty"`
+
+	// AccountStatuses matches account events by status (active, deactivated, takendown, suspended, deleted, ...);
+	// a rule with it set only matches account events
+	AccountStatuses []string `json:"accountStatuses,omitempty"`
+
+	// IdentityChanges makes the rule match only identity events (handle changes). Post and
+	// interaction conditions don't apply to them and are skipped.
+	IdentityChanges bool     `json:"identityChanges,omitempty"`
+	EmbedTypes      []string `json:"embedTypes"`
+
+	// HasEmbed matches, when true, posts with any embed, and when false plain text posts
+	HasEmbed *bool `json:"hasEmbed,omitempty"`
+
+	// Bounds on the number of mention and link facets in a post; other events aren't checked
+	MinMentions *int `json:"minMentions,omitempty"`
+	MaxMentions *int `json:"maxMentions,omitempty"`
+	MinLinks    *int `json:"minLinks,omitempty"`
+	MaxLinks    *int `json:"maxLinks,omitempty"`
+
+	// Image alt text filters; posts without images never match them. AltTextSource is "any",
+	// "present" (every image has alt text), or "absent" (at least one doesn't). AltTextRegexes
+	// match any image's alt text, e.g. markers of machine-generated descriptions.
+	AltTextSource  string   `json:"altTextSource,omitempty"`
+	AltTextRegexes []string `json:"altTextRegexes,omitempty"`
+
+	// Video filters; posts without a video never match them. Video records don't include a
+	// duration, so MaxVideoSeconds is accepted but currently has no effect.
+	MaxVideoSeconds *int     `json:"maxVideoSeconds,omitempty"`
+	VideoAspect     string   `json:"videoAspect,omitempty"` // portrait, landscape, or square
+	Langs           []string `json:"langs"`
+	IsReply         *bool    `json:"isReply,omitempty"`
+	Enabled         *bool    `json:"enabled,omitempty"` // Defaults to true when absent
+
+	// Extends names another rule whose fields this rule inherits (see resolveExtends)
+	Extends string `json:"extends,omitempty"`
+
+	// Group joins rules with AND semantics: an event matches a group only if it matches every
+	// enabled rule in it (see MatchRules). Ungrouped rules match on their own.
+	Group string `json:"group,omitempty"`
+
+	// Priority orders evaluation: higher priorities are evaluated, and listed in matchedRules,
+	// first. Rules with equal priorities keep their config order.
+	Priority int `json:"priority,omitempty"`
+
+	// StopOnFirstMatch skips every lower-priority rule once this rule matches an event
+	StopOnFirstMatch bool `json:"stopOnFirstMatch,omitempty"`
+
+	// MinReplyDepth only matches replies at least this deep in a thread. The firehose only exposes a
+	// reply's parent and root, so depth is a proxy: 1 when the parent is the root (a top-level reply)
+	// and 2 when it isn't. Values above 2 therefore behave like 2. Non-replies never match.
+	MinReplyDepth *int `json:"minReplyDepth,omitempty"`
+
+	// SelfReplyOnly matches, when true, only replies to the author's own post (self-threads), and
+	// when false only replies to someone else. Non-replies never match while it is set.
+	SelfReplyOnly *bool `json:"selfReplyOnly,omitempty"`
+
+	// HasThreadgate matches, when true, only app.bsky.feed.threadgate records, and when false
+	// only posts, without telling whether a post is gated. ThreadgateType matches gates of one
+	// type: "nobody", "anyone", "mention", "following", "followers", or "list". Gates are
+	// separate records from the posts they restrict, so both match the gate record, not the post.
+	HasThreadgate  *bool  `json:"hasThreadgate,omitempty"`
+	ThreadgateType string `json:"threadgateType,omitempty"`
+
+	// Time-of-day window ("HH:MM", 24-hour) evaluated in Timezone (IANA name, defaults to UTC).
+	// Windows where the end is before the start wrap past midnight.
+	TimeWindowStart string `json:"timeWindowStart,omitempty"`
+	TimeWindowEnd   string `json:"timeWindowEnd,omitempty"`
+	Timezone        string `json:"timezone,omitempty"`
+
+	// Clock skew checks compare a post's createdAt to server time. Posts dated more than
+	// MaxClockSkewSeconds in the future are rejected; posts backdated by more than
+	// MaxBackdateSeconds still match but are flagged with their skew in the broadcast.
+	MaxClockSkewSeconds *int `json:"maxClockSkewSeconds,omitempty"`
+	MaxBackdateSeconds  *int `json:"maxBackdateSeconds,omitempty"`
+
+	// CursorOffset gives the rule its own Jetstream connection starting this many microseconds
+	// back, instead of the shared one started from the global cursorOffset (see firehoseStream)
+	CursorOffset *int64 `json:"cursorOffset,omitempty"`
+
+	// CursorLookback is CursorOffset as a duration such as "1h"; CursorOffset wins if both are set
+	CursorLookback string `json:"cursorLookback,omitempty"`
+
+	// MaxAgeSeconds rejects posts whose createdAt is further in the past than this, e.g. during a
+	// cursor replay. Posts without a usable createdAt are handled per undatedPostPolicy.
+	MaxAgeSeconds *int `json:"maxAgeSeconds,omitempty"`
+
+	// CustomMatchers names Go matchers added with RegisterMatcher; CustomMatcherMode is "all"
+	// (default) to require every one of them, or "any" to require at least one
+	CustomMatchers    []string `json:"customMatchers,omitempty"`
+	CustomMatcherMode string   `json:"customMatcherMode,omitempty"`
+
+	// MinFollowers only matches authors with at least this many followers, using cached profiles
+	// (see profileMissPolicy for authors that aren't cached yet)
+	MinFollowers *int `json:"minFollowers,omitempty"`
+
+	// MinAccountAgeHours only matches authors whose account is at least this old, from the same cached profiles
+	MinAccountAgeHours *int `json:"minAccountAgeHours,omitempty"`
+
+	// SampleRate emits only this fraction (0.0-1.0) of the rule's matches, chosen at random.
+	// 0 means unset, so every match is emitted.
+	SampleRate float64 `json:"sampleRate,omitempty"`
+
+	// SampleMode is "random" (default) to roll for every match, or "consistent" to always keep
+	// the same authors (see authorSamplePoint)
+	SampleMode string `json:"sampleMode,omitempty"`
+
+	// AuthorCooldownSeconds limits the rule to one match per author in this window; later matches are dropped
+	AuthorCooldownSeconds *int `json:"authorCooldownSeconds,omitempty"`
+
+	// Weight is what a match of the rule adds to the broadcast's score; defaults to 1. Setting
+	// it on any rule turns scoring on.
+	Weight *float64 `json:"weight,omitempty"`
+
+	// OutputTemplate is a text/template rendered for each match into the broadcast's "rendered" map
+	OutputTemplate string `json:"outputTemplate,omitempty"`
+
+	// RedactText strips post text, embeds, and facets from broadcasts of the rule's matches
+	RedactText bool `json:"redactText,omitempty"`
+
+	// Tags are free-form labels for clients to group rules by; aperture only passes them through
+	Tags []string `json:"tags,omitempty"`
+
+	StaleWarningSeconds *int `json:"staleWarningSeconds,omitempty"` // Overrides the global stale warning threshold; 0 disables
+}
+
+// IsEnabled reports whether the rule should be compiled. Rules are enabled unless explicitly disabled.
+func (r RuleSet) IsEnabled() bool {
+	return r.Enabled == nil || *r.Enabled
 }
 
+// NatsConfig configures publishing matches to NATS
+type NatsConfig struct {
+	URL           string `json:"url"`
+	SubjectPrefix string `json:"subjectPrefix"` // Matches publish to <subjectPrefix>.<ruleName>
+	BufferSize    int    `json:"bufferSize"`    // Matches queued while the broker is slow or down
+}
+
+// SinkConfig is a sink's policy for deliveries that fail
+type SinkConfig struct {
+	MaxRetries     int    `json:"maxRetries"`     // Retries after the first attempt; 0 doesn't retry
+	RetryBackoff   string `json:"retryBackoff"`   // Duration before the first retry, doubling after each; default "1s"
+	DeadLetterFile string `json:"deadLetterFile"` // JSONL file for matches that fail every attempt; empty drops them
+}
+
+// fallibleSinks are the sinks whose deliveries can fail, and so can have a SinkConfig
+var fallibleSinks = []string{"sqlite", "nats"}
+
 type Config struct {
-	BskyServer      string    `json:"bskyServer"`
-	JetstreamServer string    `json:"jetstreamServer"`
-	Rules           []RuleSet `json:"rules"`
-	Port            int       `json:"port"`
-	CursorOffset    int64     `json:"cursorOffset"` // Microseconds to look back
+	BskyServer      string `json:"bskyServer"`
+	JetstreamServer string `json:"jetstreamServer"`
+
+	// JetstreamServers lists Jetstream endpoints to fail over between, in order; it takes precedence over JetstreamServer
+	JetstreamServers []string `json:"jetstreamServers,omitempty"`
+
+	// JetstreamCompress requests zstd-compressed frames from Jetstream to save bandwidth
+	JetstreamCompress bool      `json:"jetstreamCompress,omitempty"`
+	Rules             []RuleSet `json:"rules"`
+	Port              int       `json:"port"`
+	CursorOffset      int64     `json:"cursorOffset"` // Microseconds to look back
+
+	// CursorLookback is CursorOffset as a duration such as "1h" or "30m"; CursorOffset wins if both are set
+	CursorLookback string `json:"cursorLookback"`
+
+	// DropReplayedBeforeCursor skips events a reconnect re-delivers, by their time_us
+	DropReplayedBeforeCursor bool `json:"dropReplayedBeforeCursor"`
+
+	// CursorPath saves each stream's cursor here at shutdown; streams resume from it on startup
+	CursorPath string `json:"cursorPath"`
+
+	// MaxRuntimeSeconds shuts aperture down gracefully after running this long; 0 runs until stopped
+	MaxRuntimeSeconds int `json:"maxRuntimeSeconds"`
+
+	// StartupGraceSeconds marks matches made this soon after startup with "replay": true, so
+	// clients can tell a cursor replay's backlog from live matches
+	StartupGraceSeconds int `json:"startupGraceSeconds"`
+
+	// Global author gates applied before any rule is evaluated. A blocked DID is always dropped;
+	// when GlobalAllowDIDs is non-empty, anything not on it is dropped too.
+	GlobalBlockDIDs []string `json:"globalBlockDIDs"`
+	GlobalAllowDIDs []string `json:"globalAllowDIDs"`
+
+	// IgnoreCollections drops events from these collections before any rule is evaluated
+	IgnoreCollections []string `json:"ignoreCollections"`
+
+	// DefaultCollections are given to rules that name authors but no collections; unset means
+	// app.bsky.feed.post, and an empty list leaves such rules matching whatever is subscribed
+	DefaultCollections []string `json:"defaultCollections"`
+
+	// Handle resolution enriches broadcasts with author handles
+	ResolveHandles            bool   `json:"resolveHandles"`
+	PlcDirectory              string `json:"plcDirectory"`
+	HandleCacheTTLSeconds     int    `json:"handleCacheTTLSeconds"`
+	HandleCacheSize           int    `json:"handleCacheSize"`
+	HandleResolverConcurrency int    `json:"handleResolverConcurrency"`
+
+	// Profile enrichment for quality filters such as minFollowers
+	ProfileServer          string `json:"profileServer"`
+	ProfileCacheTTLSeconds int    `json:"profileCacheTTLSeconds"`
+	ProfileCacheSize       int    `json:"profileCacheSize"`
+	ProfileConcurrency     int    `json:"profileConcurrency"`
+	ProfileMissPolicy      string `json:"profileMissPolicy"` // allow (fail open, default) or reject (fail closed)
+
+	// Cache of reposted and quoted posts' text for subjectTextRegexes, fetched from ProfileServer
+	SubjectCacheTTLSeconds int `json:"subjectCacheTTLSeconds"`
+	SubjectCacheSize       int `json:"subjectCacheSize"`
+	SubjectConcurrency     int `json:"subjectConcurrency"`
+
+	// UndatedPostPolicy decides whether maxAgeSeconds passes posts whose createdAt is missing or
+	// unparseable: reject (default) or allow
+	UndatedPostPolicy string `json:"undatedPostPolicy"`
+
+	LogLevel  string `json:"logLevel"`  // debug, info, warn, error (default info)
+	LogFormat string `json:"logFormat"` // text or json (default text)
+
+	// DebugSampleRate is the fraction of events whose rule non-matches are logged at debug level
+	DebugSampleRate float64 `json:"debugSampleRate"`
+
+	// MatchDetails adds the triggering pattern or embed type for each matched rule to broadcasts
+	MatchDetails bool `json:"matchDetails"`
+
+	// MinScore drops events whose matched rules' weights sum to less than this; 0 disables it.
+	// Setting it turns scoring on.
+	MinScore float64 `json:"minScore"`
+
+	// TextNormalization transforms post text before rules match it: lowercase, stripZeroWidth, nfkc
+	TextNormalization []string `json:"textNormalization"`
+
+	// FoldConfusables maps lookalike letters from other scripts to ASCII after TextNormalization
+	FoldConfusables bool `json:"foldConfusables"`
+
+	// Limits on the record broadcast for a match, which is cut down past them; matching sees it in full
+	MaxTextBytes int `json:"maxTextBytes"` // 0 means unlimited
+	MaxListItems int `json:"maxListItems"` // Facets and embedded images; 0 means unlimited
+
+	// IncludeRawFrame adds each match's Jetstream frame, exactly as received, to its broadcast
+	IncludeRawFrame bool `json:"includeRawFrame"`
+
+	// AdminPort serves the operational endpoints (stats, health, subscription, match tests, pprof)
+	// on a separate port, keeping them off the public one; 0 serves everything on Port
+	AdminPort int `json:"adminPort"`
+
+	// BindAddress is the host or IP both ports listen on; empty listens on all interfaces
+	BindAddress string `json:"bindAddress"`
+
+	// EnablePprof serves Go's profiling handlers under /debug/pprof/; never expose it publicly
+	EnablePprof bool `json:"enablePprof"`
+
+	// MaxRegexProgramSize rejects rule regexes that compile to more instructions than this; default 10000
+	MaxRegexProgramSize int `json:"maxRegexProgramSize"`
+
+	// SQLite sink stores matches for ad-hoc querying when SqlitePath is set
+	SqlitePath        string `json:"sqlitePath"`
+	SqliteBatchSize   int    `json:"sqliteBatchSize"`
+	SqliteFlushMillis int    `json:"sqliteFlushMillis"`
+
+	Nats *NatsConfig `json:"nats,omitempty"`
+
+	// Sinks sets how each sink that can fail ("sqlite", "nats") retries and dead-letters
+	// failed deliveries; sinks without an entry drop them
+	Sinks map[string]SinkConfig `json:"sinks,omitempty"`
+
+	// Worker pool and queue sizing; 0 uses the defaults
+	Workers             int `json:"workers"`             // Default runtime.NumCPU()
+	JobQueueSize        int `json:"jobQueueSize"`        // Firehose events waiting for a worker
+	BroadcastBufferSize int `json:"broadcastBufferSize"` // Matches waiting to be written to websocket clients
+	ReplayBufferSize    int `json:"replayBufferSize"`    // Recent matches kept in memory for /recent; default 1000
+
+	// ReplayPersistPath saves the replay buffer to this file so /recent survives restarts; empty disables
+	ReplayPersistPath string `json:"replayPersistPath"`
+
+	// MaxBroadcastsPerSecond caps matches sent to websocket and SSE clients, dropping the excess; 0 means unlimited
+	MaxBroadcastsPerSecond int `json:"maxBroadcastsPerSecond"`
+
+	// QueueFullPolicy decides what happens when the job queue is full: block (default), dropNewest, or dropOldest
+	QueueFullPolicy string `json:"queueFullPolicy"`
+
+	MaxClients int `json:"maxClients"` // Maximum concurrent websocket clients; 0 means unlimited
+
+	// MaxMessagesPerClient closes a connection once it has been sent this many messages; 0 means unlimited
+	MaxMessagesPerClient int `json:"maxMessagesPerClient"`
+
+	// LegacyFrames sends bare BroadcastMessages to clients instead of typed envelopes, for clients
+	// that predate them
+	LegacyFrames bool `json:"legacyFrames"`
+
+	// PushStatsIntervalSeconds sends every client a stats frame this often; 0 disables it
+	PushStatsIntervalSeconds int `json:"pushStatsIntervalSeconds"`
+
+	// ClientIdleTimeoutSeconds disconnects websocket clients that send nothing (not even a pong) for this long; 0 disables
+	ClientIdleTimeoutSeconds int `json:"clientIdleTimeoutSeconds"`
+
+	// Server-initiated pings keep idle connections open through proxies. PingIntervalSeconds defaults to half
+	// the idle timeout (no pings without one); a client that doesn't answer within PongTimeoutSeconds is closed.
+	PingIntervalSeconds int `json:"pingIntervalSeconds"`
+	PongTimeoutSeconds  int `json:"pongTimeoutSeconds"`
+
+	// BroadcastBatchMillis coalesces websocket messages into array frames for clients that opt in; 0 disables
+	BroadcastBatchMillis int `json:"broadcastBatchMillis"`
+
+	// AdminToken enables token-guarded admin endpoints such as /match/test; empty disables them
+	AdminToken string `json:"adminToken"`
+
+	// AllowedOrigins limits which browser origins may open websockets: "*", "null", or hosts such
+	// as "https://example.com" or "*.example.com" (see OriginPolicy); empty allows all
+	AllowedOrigins []string `json:"allowedOrigins"`
+
+	// Per-connection websocket buffer sizes in bytes; default 1024
+	WsReadBufferSize  int `json:"wsReadBufferSize"`
+	WsWriteBufferSize int `json:"wsWriteBufferSize"`
+
+	// WsAuthToken, when set, is required to connect to /ws, /sse, and /recent
+	WsAuthToken string `json:"wsAuthToken"`
+
+	// RequireFirehoseOnStartup waits for every Jetstream connection to deliver an event before
+	// serving HTTP, exiting if one hasn't within FirehoseStartupTimeoutSeconds (default 30)
+	RequireFirehoseOnStartup      bool `json:"requireFirehoseOnStartup"`
+	FirehoseStartupTimeoutSeconds int  `json:"firehoseStartupTimeoutSeconds"`
+
+	HealthStalenessSeconds  int `json:"healthStalenessSeconds"`  // Max seconds without a firehose event before /healthz fails
+	RuleStaleWarningSeconds int `json:"ruleStaleWarningSeconds"` // Warn when an active rule stops matching for this long; 0 disables
 }
 
-func LoadConfig(path string) (*Config, error) {
-	file, err := os.Open(path)
+// ListenAddr returns the address to serve port on, bracketing IPv6 bind addresses
+func (config *Config) ListenAddr(port int) string {
+	return net.JoinHostPort(config.BindAddress, strconv.Itoa(port))
+}
+
+// LoadConfig loads a comma-separated list of config files, merged in order. Fields set in
+// later files override earlier ones, while rules and the global author lists are appended.
+// A rule name defined in more than one file is an error; unnamed rules are exempt.
+func LoadConfig(paths string) (*Config, error) {
+	var config Config
+	ruleFiles := make(map[string]string) // rule name -> file that defined it
+
+	for _, path := range strings.Split(paths, ",") {
+		path = strings.TrimSpace(path)
+		if path == "" {
+			continue
+		}
+
+		rules, blocked, allowed := config.Rules, config.GlobalBlockDIDs, config.GlobalAllowDIDs
+		// Decoding reuses slice backing arrays, so clear them before reading the next file
+		config.Rules, config.GlobalBlockDIDs, config.GlobalAllowDIDs = nil, nil, nil
+		if err := decodeConfigFile(path, &config); err != nil {
+			return nil, err
+		}
+
+		for _, rule := range config.Rules {
+			if rule.Name == "" {
+				continue // Unnamed rules are numbered by position instead (see ruleName)
+			}
+			if prev, ok := ruleFiles[rule.Name]; ok && prev != path {
+				return nil, fmt.Errorf("duplicate rule name %q in %s (already defined in %s)", rule.Name, path, prev)
+			}
+			ruleFiles[rule.Name] = path
+		}
+		config.Rules = append(rules, config.Rules...)
+		config.GlobalBlockDIDs = append(blocked, config.GlobalBlockDIDs...)
+		config.GlobalAllowDIDs = append(allowed, config.GlobalAllowDIDs...)
+	}
+
+	rules, err := resolveExtends(config.Rules)
 	if err != nil {
 		return nil, err
 	}
-	defer file.Close()
+	config.Rules = rules
 
-	var config Config
-	decoder := json.NewDecoder(file)
-	if err := decoder.Decode(&config); err != nil {
+	if _, err := ParseLookback(config.CursorLookback); err != nil {
 		return nil, err
 	}
+	for _, rule := range config.Rules {
+		if _, err := ParseLookback(rule.CursorLookback); err != nil {
+			return nil, fmt.Errorf("rule %q: %w", rule.Name, err)
+		}
+		if rule.SampleRate < 0 || rule.SampleRate > 1 {
+			return nil, fmt.Errorf("rule %q: sampleRate must be between 0 and 1, got %v", rule.Name, rule.SampleRate)
+		}
+		switch rule.VideoAspect {
+		case "", VideoPortrait, VideoLandscape, VideoSquare:
+		default:
+			return nil, fmt.Errorf("rule %q: videoAspect must be %q, %q, or %q, got %q", rule.Name, VideoPortrait, VideoLandscape, VideoSquare, rule.VideoAspect)
+		}
+		switch rule.AltTextSource {
+		case "", AltTextAny, AltTextPresent, AltTextAbsent:
+		default:
+			return nil, fmt.Errorf("rule %q: altTextSource must be %q, %q, or %q, got %q", rule.Name, AltTextAny, AltTextPresent, AltTextAbsent, rule.AltTextSource)
+		}
+		switch rule.SampleMode {
+		case "", SampleRandom, SampleConsistent:
+		default:
+			return nil, fmt.Errorf("rule %q: sampleMode must be %q or %q, got %q", rule.Name, SampleRandom, SampleConsistent, rule.SampleMode)
+		}
+		switch rule.CustomMatcherMode {
+		case "", CustomMatchAll, CustomMatchAny:
+		default:
+			return nil, fmt.Errorf("rule %q: customMatcherMode must be %q or %q, got %q", rule.Name, CustomMatchAll, CustomMatchAny, rule.CustomMatcherMode)
+		}
+		switch rule.ThreadgateType {
+		case "", ThreadgateNobody, ThreadgateAnyone, ThreadgateMention, ThreadgateFollowing, ThreadgateFollowers, ThreadgateList:
+		default:
+			return nil, fmt.Errorf("rule %q: threadgateType must be %q, %q, %q, %q, %q, or %q, got %q", rule.Name,
+				ThreadgateNobody, ThreadgateAnyone, ThreadgateMention, ThreadgateFollowing, ThreadgateFollowers, ThreadgateList, rule.ThreadgateType)
+		}
+		if rule.StopOnFirstMatch && rule.Group != "" {
+			// Stopping could skip the rest of the group, leaving it matched without every member checked
+			return nil, fmt.Errorf("rule %q: stopOnFirstMatch can't be used on a grouped rule", rule.Name)
+		}
+	}
+
+	if config.DebugSampleRate < 0 || config.DebugSampleRate > 1 {
+		return nil, fmt.Errorf("debugSampleRate must be between 0 and 1, got %v", config.DebugSampleRate)
+	}
+	if config.Workers < 0 {
+		return nil, fmt.Errorf("workers must be positive, got %d", config.Workers)
+	}
+	if config.JobQueueSize < 0 {
+		return nil, fmt.Errorf("jobQueueSize must be positive, got %d", config.JobQueueSize)
+	}
+	if config.BroadcastBufferSize < 0 {
+		return nil, fmt.Errorf("broadcastBufferSize must be positive, got %d", config.BroadcastBufferSize)
+	}
+	if config.StartupGraceSeconds < 0 {
+		return nil, fmt.Errorf("startupGraceSeconds must not be negative, got %d", config.StartupGraceSeconds)
+	}
+	if config.MaxBroadcastsPerSecond < 0 {
+		return nil, fmt.Errorf("maxBroadcastsPerSecond must not be negative, got %d", config.MaxBroadcastsPerSecond)
+	}
+	if config.Workers == 0 {
+		config.Workers = runtime.NumCPU()
+	}
+	if config.JobQueueSize == 0 {
+		config.JobQueueSize = 1000
+	}
+	if config.BroadcastBufferSize == 0 {
+		config.BroadcastBufferSize = 1000
+	}
+	if config.ReplayBufferSize < 0 {
+		return nil, fmt.Errorf("replayBufferSize must be positive, got %d", config.ReplayBufferSize)
+	}
+	if config.ReplayBufferSize == 0 {
+		config.ReplayBufferSize = 1000
+	}
+	if config.AdminPort < 0 {
+		return nil, fmt.Errorf("adminPort must be positive, got %d", config.AdminPort)
+	}
+	if config.AdminPort != 0 && config.AdminPort == config.Port {
+		return nil, fmt.Errorf("adminPort must differ from port (%d)", config.Port)
+	}
+	// IPv6 literals may be written with or without brackets; JoinHostPort adds them back
+	config.BindAddress = strings.TrimSuffix(strings.TrimPrefix(config.BindAddress, "["), "]")
+	if config.BindAddress != "" {
+		if _, err := net.ResolveTCPAddr("tcp", config.ListenAddr(config.Port)); err != nil {
+			return nil, fmt.Errorf("invalid bindAddress %q: %w", config.BindAddress, err)
+		}
+	}
+	if config.MaxTextBytes < 0 {
+		return nil, fmt.Errorf("maxTextBytes must be positive, got %d", config.MaxTextBytes)
+	}
+	if config.MaxListItems < 0 {
+		return nil, fmt.Errorf("maxListItems must be positive, got %d", config.MaxListItems)
+	}
+	if config.MaxRegexProgramSize < 0 {
+		return nil, fmt.Errorf("maxRegexProgramSize must be positive, got %d", config.MaxRegexProgramSize)
+	}
+	if config.MaxRegexProgramSize == 0 {
+		config.MaxRegexProgramSize = 10000
+	}
+	if config.DefaultCollections == nil {
+		config.DefaultCollections = []string{"app.bsky.feed.post"}
+	}
+	switch config.QueueFullPolicy {
+	case "":
+		config.QueueFullPolicy = QueueFullBlock
+	case QueueFullBlock, QueueFullDropNewest, QueueFullDropOldest:
+	default:
+		return nil, fmt.Errorf("queueFullPolicy must be %q, %q, or %q, got %q", QueueFullBlock, QueueFullDropNewest, QueueFullDropOldest, config.QueueFullPolicy)
+	}
+	if config.MaxClients < 0 {
+		return nil, fmt.Errorf("maxClients must not be negative, got %d", config.MaxClients)
+	}
+	if config.MaxRuntimeSeconds < 0 {
+		return nil, fmt.Errorf("maxRuntimeSeconds must not be negative, got %d", config.MaxRuntimeSeconds)
+	}
+	if config.PushStatsIntervalSeconds < 0 {
+		return nil, fmt.Errorf("pushStatsIntervalSeconds must not be negative, got %d", config.PushStatsIntervalSeconds)
+	}
+	if config.MaxMessagesPerClient < 0 {
+		return nil, fmt.Errorf("maxMessagesPerClient must not be negative, got %d", config.MaxMessagesPerClient)
+	}
+	if config.ClientIdleTimeoutSeconds < 0 {
+		return nil, fmt.Errorf("clientIdleTimeoutSeconds must not be negative, got %d", config.ClientIdleTimeoutSeconds)
+	}
+	if config.PingIntervalSeconds < 0 {
+		return nil, fmt.Errorf("pingIntervalSeconds must not be negative, got %d", config.PingIntervalSeconds)
+	}
+	if config.PongTimeoutSeconds <= 0 {
+		config.PongTimeoutSeconds = 10
+	}
+	if config.BroadcastBatchMillis < 0 {
+		return nil, fmt.Errorf("broadcastBatchMillis must not be negative, got %d", config.BroadcastBatchMillis)
+	}
+	if config.WsReadBufferSize < 0 {
+		return nil, fmt.Errorf("wsReadBufferSize must be positive, got %d", config.WsReadBufferSize)
+	}
+	if config.WsReadBufferSize == 0 {
+		config.WsReadBufferSize = 1024
+	}
+	if config.WsWriteBufferSize < 0 {
+		return nil, fmt.Errorf("wsWriteBufferSize must be positive, got %d", config.WsWriteBufferSize)
+	}
+	if config.WsWriteBufferSize == 0 {
+		config.WsWriteBufferSize = 1024
+	}
+	if config.FirehoseStartupTimeoutSeconds <= 0 {
+		config.FirehoseStartupTimeoutSeconds = 30
+	}
+	if config.HealthStalenessSeconds <= 0 {
+		config.HealthStalenessSeconds = 60
+	}
+	if config.SqliteBatchSize <= 0 {
+		config.SqliteBatchSize = 500
+	}
+	if config.SqliteFlushMillis <= 0 {
+		config.SqliteFlushMillis = 1000
+	}
+	if config.Nats != nil {
+		if config.Nats.SubjectPrefix == "" {
+			config.Nats.SubjectPrefix = "aperture"
+		}
+		if config.Nats.BufferSize <= 0 {
+			config.Nats.BufferSize = 10000
+		}
+	}
+	for name, sink := range config.Sinks {
+		if !slices.Contains(fallibleSinks, name) {
+			return nil, fmt.Errorf("sinks: unknown sink %q, must be one of %v", name, fallibleSinks)
+		}
+		if sink.MaxRetries < 0 {
+			return nil, fmt.Errorf("sinks.%s.maxRetries must not be negative, got %d", name, sink.MaxRetries)
+		}
+		if sink.RetryBackoff == "" {
+			sink.RetryBackoff = "1s"
+		}
+		if d, err := time.ParseDuration(sink.RetryBackoff); err != nil || d < 0 {
+			return nil, fmt.Errorf("sinks.%s.retryBackoff must be a duration such as \"500ms\", got %q", name, sink.RetryBackoff)
+		}
+		config.Sinks[name] = sink
+	}
+	if config.PlcDirectory == "" {
+		config.PlcDirectory = "https://plc.directory"
+	}
+	if config.HandleCacheTTLSeconds <= 0 {
+		config.HandleCacheTTLSeconds = 3600
+	}
+	if config.HandleCacheSize <= 0 {
+		config.HandleCacheSize = 100000
+	}
+	if config.HandleResolverConcurrency <= 0 {
+		config.HandleResolverConcurrency = 8
+	}
+	if config.ProfileServer == "" {
+		config.ProfileServer = "https://public.api.bsky.app"
+	}
+	if config.ProfileCacheTTLSeconds <= 0 {
+		config.ProfileCacheTTLSeconds = 3600
+	}
+	if config.ProfileCacheSize <= 0 {
+		config.ProfileCacheSize = 100000
+	}
+	if config.ProfileConcurrency <= 0 {
+		config.ProfileConcurrency = 8
+	}
+	if config.SubjectCacheTTLSeconds <= 0 {
+		config.SubjectCacheTTLSeconds = 3600
+	}
+	if config.SubjectCacheSize <= 0 {
+		config.SubjectCacheSize = 100000
+	}
+	if config.SubjectConcurrency <= 0 {
+		config.SubjectConcurrency = 8
+	}
+	switch config.ProfileMissPolicy {
+	case "":
+		config.ProfileMissPolicy = ProfileMissAllow
+	case ProfileMissAllow, ProfileMissReject:
+	default:
+		return nil, fmt.Errorf("profileMissPolicy must be %q or %q, got %q", ProfileMissAllow, ProfileMissReject, config.ProfileMissPolicy)
+	}
+	switch config.UndatedPostPolicy {
+	case "":
+		config.UndatedPostPolicy = UndatedReject
+	case UndatedReject, UndatedAllow:
+	default:
+		return nil, fmt.Errorf("undatedPostPolicy must be %q or %q, got %q", UndatedReject, UndatedAllow, config.UndatedPostPolicy)
+	}
 
 	return &config, nil
 }
+
+// decodeConfigFile decodes one config file over the fields already in config
+func decodeConfigFile(path string, config *Config) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if err := json.NewDecoder(file).Decode(config); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return nil
+}
+
+// ParseLookback converts a cursorLookback duration to microseconds; "" is 0
+func ParseLookback(s string) (int64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid cursorLookback: %w", err)
+	}
+	if d < 0 {
+		return 0, fmt.Errorf("cursorLookback must not be negative, got %q", s)
+	}
+	return d.Microseconds(), nil
+}
+
+// ruleName returns the name of the rule at index i of the config, numbering unnamed rules
+func ruleName(i int, rule RuleSet) string {
+	if rule.Name != "" {
+		return rule.Name
+	}
+	return fmt.Sprintf("Rule #%d", i+1)
+}
+
+// changedSettings returns the JSON names of the top-level settings that differ between two
+// configs, ignoring their rules
+func changedSettings(a, b *Config) []string {
+	av, bv := reflect.ValueOf(a).Elem(), reflect.ValueOf(b).Elem()
+	t := av.Type()
+	var changed []string
+	for i := 0; i < t.NumField(); i++ {
+		if t.Field(i).Name == "Rules" {
+			continue
+		}
+		if !reflect.DeepEqual(av.Field(i).Interface(), bv.Field(i).Interface()) {
+			name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+			changed = append(changed, name)
+		}
+	}
+	return changed
+}
+
+// resolveExtends applies rule inheritance. A rule with Extends inherits every field from the
+// named rule (itself resolved first): slices are concatenated, parent entries first, while
+// strings, numbers, and pointers (e.g. isReply) take the child's value when it sets one and
+// the parent's otherwise. Name, Extends, Enabled, and Group are never inherited (see the
+// README). Unknown parents and cycles are errors.
+func resolveExtends(rules []RuleSet) ([]RuleSet, error) {
+	byName := make(map[string]int, len(rules))
+	for i, rule := range rules {
+		byName[rule.Name] = i
+	}
+
+	resolved := make([]RuleSet, len(rules))
+	done := make([]bool, len(rules))
+	visiting := make([]bool, len(rules))
+
+	var resolve func(i int, chain []string) error
+	resolve = func(i int, chain []string) error {
+		if done[i] {
+			return nil
+		}
+		rule := rules[i]
+		chain = append(chain, rule.Name)
+		if rule.Extends == "" {
+			resolved[i], done[i] = rule, true
+			return nil
+		}
+		if visiting[i] {
+			return fmt.Errorf("rule inheritance cycle: %s", strings.Join(chain, " -> "))
+		}
+		parent, ok := byName[rule.Extends]
+		if !ok {
+			return fmt.Errorf("rule %q extends unknown rule %q", rule.Name, rule.Extends)
+		}
+
+		visiting[i] = true
+		if err := resolve(parent, chain); err != nil {
+			return err
+		}
+		visiting[i] = false
+
+		resolved[i], done[i] = inheritRule(rule, resolved[parent]), true
+		return nil
+	}
+
+	for i := range rules {
+		if err := resolve(i, nil); err != nil {
+			return nil, err
+		}
+	}
+	return resolved, nil
+}
+
+// inheritRule fills child's unset fields from parent and prepends parent's list entries
+func inheritRule(child, parent RuleSet) RuleSet {
+	merged := child
+	mv := reflect.ValueOf(&merged).Elem()
+	pv := reflect.ValueOf(parent)
+	t := mv.Type()
+
+	for i := 0; i < t.NumField(); i++ {
+		switch t.Field(i).Name {
+		case "Name", "Extends", "Enabled", "Group":
+			continue
+		}
+		field, inherited := mv.Field(i), pv.Field(i)
+		if field.Kind() == reflect.Slice {
+			if inherited.Len() > 0 {
+				combined := reflect.MakeSlice(field.Type(), 0, inherited.Len()+field.Len())
+				combined = reflect.AppendSlice(combined, inherited)
+				field.Set(reflect.AppendSlice(combined, field))
+			}
+			continue
+		}
+		if field.IsZero() {
+			field.Set(inherited)
+		}
+	}
+	return merged
+}
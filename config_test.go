@@ -0,0 +1,58 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeConfig writes a config file into dir and returns its path
+func writeConfig(t *testing.T, dir, name, body string) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte(body), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfigUnnamedRules(t *testing.T) {
+	path := writeConfig(t, t.TempDir(), "a.json", `{"rules": [
+		{"collections": ["app.bsky.feed.post"], "textRegexes": ["golang"]},
+		{"collections": ["app.bsky.feed.post"], "textRegexes": ["rust"]}
+	]}`)
+	config, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("two unnamed rules failed to load: %v", err)
+	}
+	if len(config.Rules) != 2 {
+		t.Fatalf("loaded %d rules, want 2", len(config.Rules))
+	}
+	if a, b := ruleName(0, config.Rules[0]), ruleName(1, config.Rules[1]); a != "Rule #1" || b != "Rule #2" {
+		t.Errorf("unnamed rules are called %q and %q, want Rule #1 and Rule #2", a, b)
+	}
+}
+
+func TestLoadConfigDuplicateAcrossFiles(t *testing.T) {
+	dir := t.TempDir()
+	a := writeConfig(t, dir, "a.json", `{"rules": [{"name": "news", "collections": ["app.bsky.feed.post"]}, {"collections": ["app.bsky.feed.like"]}]}`)
+	b := writeConfig(t, dir, "b.json", `{"rules": [{"name": "news", "collections": ["app.bsky.feed.repost"]}, {"collections": ["app.bsky.feed.like"]}]}`)
+
+	_, err := LoadConfig(a + "," + b)
+	if err == nil {
+		t.Fatal("a rule name defined in two files loaded without error")
+	}
+	if msg := err.Error(); !strings.Contains(msg, `"news"`) || !strings.Contains(msg, a) || !strings.Contains(msg, b) {
+		t.Errorf("error %q should name the rule and both files", msg)
+	}
+
+	c := writeConfig(t, dir, "c.json", `{"rules": [{"name": "art", "collections": ["app.bsky.feed.post"]}]}`)
+	config, err := LoadConfig(a + "," + c)
+	if err != nil {
+		t.Fatalf("files with distinct names and unnamed rules failed to merge: %v", err)
+	}
+	if len(config.Rules) != 3 {
+		t.Errorf("merged %d rules, want 3", len(config.Rules))
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/text/width"
+)
+
+// confusables maps letters from other scripts that look like ASCII letters to the letter they
+// imitate. It's a curated subset of Unicode's confusables list covering the homoglyphs seen in
+// keyword evasion; the full list has thousands of entries, most of them for symbols or scripts
+// that don't pass for Latin text.
+var confusables = map[rune]rune{
+	// Cyrillic
+	'\u0430': 'a', '\u0435': 'e', '\u043e': 'o', '\u0440': 'p', '\u0441': 'c', '\u0443': 'y',
+	'\u0445': 'x', '\u0455': 's', '\u0456': 'i', '\u0457': 'i', '\u0458': 'j', '\u04bb': 'h',
+	'\u04cf': 'l', '\u0501': 'd', '\u051b': 'q', '\u051d': 'w', '\u0405': 'S', '\u0406': 'I',
+	'\u0408': 'J', '\u0410': 'A', '\u0412': 'B', '\u0415': 'E', '\u041a': 'K', '\u041c': 'M',
+	'\u041d': 'H', '\u041e': 'O', '\u0420': 'P', '\u0421': 'C', '\u0422': 'T', '\u0423': 'Y',
+	'\u0425': 'X', '\u04ba': 'H', '\u04c0': 'I', '\u051a': 'Q', '\u051c': 'W',
+	// Greek
+	'\u03b1': 'a', '\u03b9': 'i', '\u03ba': 'k', '\u03bd': 'v', '\u03bf': 'o', '\u03c1': 'p',
+	'\u03c5': 'u', '\u03c7': 'x', '\u0391': 'A', '\u0392': 'B', '\u0395': 'E', '\u0396': 'Z',
+	'\u0397': 'H', '\u0399': 'I', '\u039a': 'K', '\u039c': 'M', '\u039d': 'N', '\u039f': 'O',
+	'\u03a1': 'P', '\u03a4': 'T', '\u03a5': 'Y', '\u03a7': 'X',
+	// Armenian
+	'\u0570': 'h', '\u0578': 'n', '\u057d': 'u', '\u0581': 'g', '\u0585': 'o',
+	// Latin letters that aren't ASCII but look like it, including small capitals
+	'\u0131': 'i', '\u0251': 'a', '\u0261': 'g', '\u0269': 'i', '\u0274': 'n', '\u028f': 'y',
+	'\u0299': 'b', '\u029c': 'h', '\u1d00': 'a', '\u1d04': 'c', '\u1d05': 'd', '\u1d07': 'e',
+	'\u1d0a': 'j', '\u1d0b': 'k', '\u1d0d': 'm', '\u1d0f': 'o', '\u1d18': 'p', '\u1d1b': 't',
+	'\u1d1c': 'u', '\u1d20': 'v', '\u1d21': 'w', '\u1d22': 'z',
+}
+
+// FoldConfusables maps fullwidth characters and the homoglyphs in confusables to their ASCII
+// lookalikes, so "ѕсаm" reads as "scam". ASCII text is returned as is without allocating.
+func FoldConfusables(text string) string {
+	ascii := true
+	for i := 0; i < len(text); i++ {
+		if text[i] >= utf8.RuneSelf {
+			ascii = false
+			break
+		}
+	}
+	if ascii {
+		return text
+	}
+	return strings.Map(func(r rune) rune {
+		if folded, ok := confusables[r]; ok {
+			return folded
+		}
+		return r
+	}, width.Fold.String(text))
+}
@@ -0,0 +1,362 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/TheAlyxGreen/firefly"
+	"github.com/bluesky-social/jetstream/pkg/models"
+	"github.com/gorilla/websocket"
+	"github.com/klauspost/compress/zstd"
+)
+
+// publicJetstreams are the instances used when no Jetstream server is configured
+var publicJetstreams = []string{
+	"wss://jetstream1.us-east.bsky.network/subscribe",
+	"wss://jetstream2.us-east.bsky.network/subscribe",
+	"wss://jetstream1.us-west.bsky.network/subscribe",
+	"wss://jetstream2.us-west.bsky.network/subscribe",
+}
+
+const (
+	jetstreamReadTimeout  = 5 * time.Minute // Reconnect if nothing, not even a pong, arrives for this long
+	jetstreamPingInterval = time.Minute
+	jetstreamMaxBackoff   = 2 * time.Minute
+	jetstreamFailoverAt   = 3 // Consecutive failed connections before moving to the next server
+
+	// Jetstream's limits on subscription filters; extra entries are ignored
+	maxWantedCollections = 100
+	maxWantedDids        = 10000
+)
+
+// JetstreamOptions configures a Jetstream subscription
+type JetstreamOptions struct {
+	Servers     []string // Tried in order, moving on after repeated failures; empty uses the public instances
+	Collections []string // Empty subscribes to every collection
+	Authors     []string // Empty subscribes to every author
+	Cursor      *int64   // time_us to start from; nil starts at the live tip
+
+	// Compress requests zstd-compressed frames, which Jetstream encodes with a shared
+	// dictionary. This cuts bandwidth substantially for a little CPU.
+	Compress bool
+
+	// DropReplayed skips events a reconnect re-delivers: after reconnecting, events with a
+	// time_us at or before the newest one already handled are dropped
+	DropReplayed bool
+}
+
+// JetstreamConsumer reads events from Jetstream, reconnecting with exponential backoff. Firefly's
+// StreamEvents can request compressed frames but can't decode them, and it drops events when its
+// own buffer is full, so aperture reads the stream itself and parses frames with
+// ParseJetstreamEvent. Reconnects resume from the last event received rather than the
+// original cursor. Cursors are time_us wall-clock timestamps, so they carry over when the
+// consumer fails over to another server.
+type JetstreamConsumer struct {
+	client  *firefly.Firefly // Used by ParseJetstreamEvent to build blob URLs
+	opts    JetstreamOptions
+	servers []string
+	decoder *zstd.Decoder // Set when Compress is enabled
+	cursor  atomic.Int64  // time_us of the last event received; 0 until there is one
+	newest  int64         // Highest time_us handled, for DropReplayed; only touched by Run
+
+	firstEvent chan struct{} // Closed when the first event is handled
+	connected  atomic.Bool   // Whether any connection has succeeded
+
+	mu           sync.Mutex // Guards the fields below, which other goroutines read or change
+	authors      []string
+	server       string // The server currently in use
+	conn         *websocket.Conn
+	resubscribed bool
+	lastErr      error // Why the last connection ended
+}
+
+// SubscriptionInfo is the JSON body returned by /subscription
+type SubscriptionInfo struct {
+	Server         string   `json:"server"`
+	Collections    []string `json:"collections"`
+	AllCollections bool     `json:"allCollections"`
+	AuthorCount    int      `json:"authorCount"`
+	AllAuthors     bool     `json:"allAuthors"`
+	Cursor         int64    `json:"cursor,omitempty"` // Where a reconnect would resume; omitted at the live tip
+	Compress       bool     `json:"compress"`
+
+	// Set for connections opened for rules with their own cursorOffset (see firehoseStream)
+	CursorOffset *int64             `json:"cursorOffset,omitempty"`
+	Rules        []string           `json:"rules,omitempty"`
+	Streams      []SubscriptionInfo `json:"streams,omitempty"` // Further connections, listed on the first
+}
+
+func NewJetstreamConsumer(client *firefly.Firefly, opts JetstreamOptions) (*JetstreamConsumer, error) {
+	c := &JetstreamConsumer{client: client, opts: opts, servers: opts.Servers, authors: opts.Authors, firstEvent: make(chan struct{})}
+	if opts.Cursor != nil {
+		c.cursor.Store(*opts.Cursor)
+	}
+	if len(c.servers) == 0 {
+		// Start at a random public instance so restarts spread across them
+		start := rand.IntN(len(publicJetstreams))
+		c.servers = append(slices.Clone(publicJetstreams[start:]), publicJetstreams[:start]...)
+	}
+	if opts.Compress {
+		decoder, err := zstd.NewReader(nil, zstd.WithDecoderDicts(models.ZSTDDictionary))
+		if err != nil {
+			return nil, fmt.Errorf("failed to create zstd decoder: %w", err)
+		}
+		c.decoder = decoder
+	}
+	return c, nil
+}
+
+// Run consumes the stream until ctx is cancelled, passing each event to handle along with the
+// frame's JSON as received (after decompression), which handle may keep. handle runs on
+// the reading goroutine, so a slow handler applies backpressure to the connection. After
+// jetstreamFailoverAt connections in a row fail without delivering an event, it moves to the
+// next server, cycling back to the first after the last.
+func (c *JetstreamConsumer) Run(ctx context.Context, handle func(*firefly.FirehoseEvent, []byte)) {
+	backoff := time.Second
+	current, failures := 0, 0
+	for ctx.Err() == nil {
+		server := c.servers[current]
+		c.mu.Lock()
+		c.server = server
+		c.mu.Unlock()
+
+		received, err := c.connect(ctx, server, handle)
+		if ctx.Err() != nil {
+			return
+		}
+		c.mu.Lock()
+		resubscribed := c.resubscribed
+		c.resubscribed = false
+		c.mu.Unlock()
+		if resubscribed {
+			// Reconnect straight away with the new filter, resuming from the last event
+			backoff, failures = time.Second, 0
+			continue
+		}
+		slog.Warn("Firehose error", "server", server, "error", err)
+		c.mu.Lock()
+		c.lastErr = err
+		c.mu.Unlock()
+		if received {
+			backoff, failures = time.Second, 0
+		} else {
+			failures++
+		}
+		if failures >= jetstreamFailoverAt && len(c.servers) > 1 {
+			current, failures = (current+1)%len(c.servers), 0
+			slog.Warn("Switching Jetstream server", "from", server, "to", c.servers[current])
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		if backoff < jetstreamMaxBackoff {
+			backoff *= 2
+		}
+	}
+}
+
+// Resubscribe changes the authors the subscription is filtered to (nil for every author),
+// reconnecting with the new filter if it differs. No events are lost, since the new
+// connection resumes from the last event received.
+func (c *JetstreamConsumer) Resubscribe(authors []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if sameAuthors(c.authors, authors) {
+		return
+	}
+	c.authors = authors
+	slog.Info("Updating Jetstream subscription", "authors", len(authors))
+	if c.conn != nil {
+		c.resubscribed = true
+		c.conn.Close()
+	}
+}
+
+// Subscription describes the subscription as it stands, including changes from Resubscribe
+func (c *JetstreamConsumer) Subscription() SubscriptionInfo {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	info := SubscriptionInfo{
+		Server:         c.server,
+		Collections:    c.opts.Collections,
+		AllCollections: len(c.opts.Collections) == 0,
+		AuthorCount:    min(len(c.authors), maxWantedDids),
+		AllAuthors:     len(c.authors) == 0,
+		Cursor:         c.cursor.Load(),
+		Compress:       c.opts.Compress,
+	}
+	if info.Collections == nil {
+		info.Collections = []string{}
+	}
+	return info
+}
+
+// sameAuthors reports whether two author filters select the same DIDs
+func sameAuthors(a, b []string) bool {
+	if len(a) != len(b) || (a == nil) != (b == nil) {
+		return false
+	}
+	seen := make(map[string]bool, len(a))
+	for _, did := range a {
+		seen[did] = true
+	}
+	for _, did := range b {
+		if !seen[did] {
+			return false
+		}
+	}
+	return true
+}
+
+// connect streams from a single connection until it fails, reporting whether it delivered any events
+func (c *JetstreamConsumer) connect(ctx context.Context, server string, handle func(*firefly.FirehoseEvent, []byte)) (received bool, err error) {
+	endpoint, err := c.subscribeURL(server)
+	if err != nil {
+		return false, err
+	}
+
+	dialer := *websocket.DefaultDialer
+	dialer.HandshakeTimeout = 10 * time.Second
+	conn, _, err := dialer.DialContext(ctx, endpoint, http.Header{})
+	if err != nil {
+		return false, fmt.Errorf("websocket dial failed: %w", err)
+	}
+	defer conn.Close()
+	c.mu.Lock()
+	c.conn = conn
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		c.conn = nil
+		c.mu.Unlock()
+	}()
+	slog.Info("Connected to Jetstream", "server", server, "compressed", c.decoder != nil)
+	c.connected.Store(true)
+
+	// Everything up to here was handled on an earlier connection
+	var replayedUpTo int64
+	if c.opts.DropReplayed {
+		replayedUpTo = c.newest
+	}
+
+	conn.SetReadDeadline(time.Now().Add(jetstreamReadTimeout))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(jetstreamReadTimeout))
+	})
+
+	// Pings are the only writes, so this goroutine is the connection's single writer
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(jetstreamPingInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(writeWait))
+			case <-ctx.Done():
+				conn.Close() // Unblocks the read below
+				return
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	for {
+		msgType, data, err := conn.ReadMessage()
+		if err != nil {
+			return received, err
+		}
+		conn.SetReadDeadline(time.Now().Add(jetstreamReadTimeout))
+
+		if msgType == websocket.BinaryMessage && c.decoder != nil {
+			data, err = c.decoder.DecodeAll(data, nil)
+			if err != nil {
+				RecordMalformedEvent()
+				slog.Warn("Error decompressing Jetstream frame", "error", err)
+				continue
+			}
+		}
+
+		event, err := ParseJetstreamEvent(c.client, data)
+		if err != nil {
+			RecordMalformedEvent()
+			slog.Debug("Skipping invalid Jetstream event", "error", err, "event", string(data))
+			continue
+		}
+		c.cursor.Store(event.Sequence)
+		received = true
+		if event.Sequence <= replayedUpTo {
+			RecordReplayDropped()
+			continue
+		}
+		c.newest = max(c.newest, event.Sequence)
+		select {
+		case <-c.firstEvent:
+		default:
+			close(c.firstEvent) // Only Run closes it, so this can't race
+		}
+		handle(event, data)
+	}
+}
+
+// WaitForEvent blocks until the consumer has handled its first event, returning an error that
+// says whether it ever connected if ctx is done first
+func (c *JetstreamConsumer) WaitForEvent(ctx context.Context) error {
+	select {
+	case <-c.firstEvent:
+		return nil
+	case <-ctx.Done():
+	}
+	if c.connected.Load() {
+		return errors.New("connected, but no events arrived")
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.lastErr != nil {
+		return fmt.Errorf("could not connect: %w", c.lastErr)
+	}
+	return errors.New("could not connect")
+}
+
+// subscribeURL adds the subscription's filters and the current cursor to a server URL
+func (c *JetstreamConsumer) subscribeURL(server string) (string, error) {
+	u, err := url.Parse(server)
+	if err != nil {
+		return "", fmt.Errorf("invalid jetstream server %q: %w", server, err)
+	}
+	q := u.Query()
+	for _, collection := range c.opts.Collections {
+		q.Add("wantedCollections", collection)
+	}
+	c.mu.Lock()
+	for i, did := range c.authors {
+		if i == maxWantedDids {
+			break
+		}
+		q.Add("wantedDids", did)
+	}
+	c.mu.Unlock()
+	if cursor := c.cursor.Load(); cursor != 0 {
+		q.Set("cursor", strconv.FormatInt(cursor, 10))
+	}
+	if c.opts.Compress {
+		q.Set("compress", "true")
+	}
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
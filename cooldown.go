@@ -0,0 +1,81 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// maxCooldownAuthors caps how many authors a single rule's cooldown remembers
+const maxCooldownAuthors = 100000
+
+// AuthorCooldown limits a rule to one match per author per window. It is shared by all
+// workers. Since every entry lives for the same window, entries expire in the order they
+// were added, so a FIFO queue finds expired entries without scanning the whole map.
+type AuthorCooldown struct {
+	window     time.Duration
+	maxEntries int
+
+	mu    sync.Mutex
+	last  map[string]time.Time // Author DID -> time of their last allowed match
+	order []cooldownEntry      // Entries in the order they were added, oldest first
+}
+
+type cooldownEntry struct {
+	did     string
+	matched time.Time
+}
+
+func NewAuthorCooldown(window time.Duration, maxEntries int) *AuthorCooldown {
+	return &AuthorCooldown{
+		window:     window,
+		maxEntries: maxEntries,
+		last:       make(map[string]time.Time),
+	}
+}
+
+// Ready reports whether the author is outside their cooldown, without starting a new one
+func (c *AuthorCooldown) Ready(did string, now time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	last, ok := c.last[did]
+	return !ok || now.Sub(last) >= c.window
+}
+
+// Allow reports whether the author is outside their cooldown and, if so, starts a new one
+func (c *AuthorCooldown) Allow(did string, now time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.expireLocked(now)
+	if last, ok := c.last[did]; ok && now.Sub(last) < c.window {
+		return false
+	}
+
+	// When full, forget the author closest to expiring; they may match again a little early
+	for len(c.last) >= c.maxEntries && len(c.order) > 0 {
+		c.popLocked()
+	}
+	c.last[did] = now
+	c.order = append(c.order, cooldownEntry{did: did, matched: now})
+	return true
+}
+
+// expireLocked drops entries whose window has passed. Callers must hold c.mu.
+func (c *AuthorCooldown) expireLocked(now time.Time) {
+	for len(c.order) > 0 && now.Sub(c.order[0].matched) >= c.window {
+		c.popLocked()
+	}
+}
+
+// popLocked removes the oldest entry. Callers must hold c.mu.
+func (c *AuthorCooldown) popLocked() {
+	entry := c.order[0]
+	c.order = c.order[1:]
+	// Only delete if the author hasn't matched again since this entry was queued
+	if c.last[entry.did].Equal(entry.matched) {
+		delete(c.last, entry.did)
+	}
+	if len(c.order) == 0 {
+		c.order = nil // Release the backing array rather than letting it creep forward forever
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// didFileDebounce is how long a list file must go unchanged before it is reloaded, so a
+// file written in several steps is only read once it's complete
+const didFileDebounce = 500 * time.Millisecond
+
+// DIDSet is a set of DIDs that can be replaced atomically while workers read it
+type DIDSet struct {
+	dids atomic.Pointer[map[string]bool]
+}
+
+func NewDIDSet(dids map[string]bool) *DIDSet {
+	s := &DIDSet{}
+	s.dids.Store(&dids)
+	return s
+}
+
+// Has reports whether the set contains the DID
+func (s *DIDSet) Has(did string) bool {
+	return (*s.dids.Load())[did]
+}
+
+// All returns the current contents of the set, which callers must not modify
+func (s *DIDSet) All() map[string]bool {
+	return *s.dids.Load()
+}
+
+// DIDList is a rule's set of DIDs, kept in parts so the large sets loaded from list files
+// are shared by every rule that names the same file instead of being copied into each rule.
+// An empty DIDList means the rule has no such condition.
+type DIDList []*DIDSet
+
+// Contains reports whether any part of the list has the DID
+func (l DIDList) Contains(did string) bool {
+	for _, set := range l {
+		if set.Has(did) {
+			return true
+		}
+	}
+	return false
+}
+
+// DIDFiles loads DID list files, reading each file once no matter how many rules name it,
+// and can watch them to reload changes in place
+type DIDFiles struct {
+	files map[string]*didFile // Keyed by kind and absolute path
+}
+
+type didFile struct {
+	kind    string
+	path    string // Absolute
+	resolve func(string) (string, error)
+	set     *DIDSet
+}
+
+func NewDIDFiles() *DIDFiles {
+	return &DIDFiles{files: make(map[string]*didFile)}
+}
+
+// Load returns the set of DIDs in a list file, which has one entry per line; blank lines and
+// lines starting with # are ignored. kind names the list in errors and keeps lists that
+// resolve entries differently apart. resolve maps each entry to a DID; when it is nil,
+// every entry must already be a DID.
+func (f *DIDFiles) Load(kind, path string, resolve func(string) (string, error)) (*DIDSet, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	key := kind + ":" + abs
+	if file, ok := f.files[key]; ok {
+		return file.set, nil
+	}
+
+	file := &didFile{kind: kind, path: abs, resolve: resolve}
+	dids, err := file.read()
+	if err != nil {
+		return nil, err
+	}
+	file.set = NewDIDSet(dids)
+	f.files[key] = file
+	return file.set, nil
+}
+
+// read parses the file's current contents
+func (file *didFile) read() (map[string]bool, error) {
+	fh, err := os.Open(file.path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", file.kind, err)
+	}
+	defer fh.Close()
+
+	dids := make(map[string]bool)
+	scanner := bufio.NewScanner(fh)
+	for line := 1; scanner.Scan(); line++ {
+		entry := strings.TrimSpace(scanner.Text())
+		if entry == "" || strings.HasPrefix(entry, "#") {
+			continue
+		}
+		if file.resolve != nil {
+			entry, err = file.resolve(entry)
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %w", file.path, line, err)
+			}
+		} else if !strings.HasPrefix(entry, "did:") {
+			return nil, fmt.Errorf("%s:%d: %q is not a DID", file.path, line, entry)
+		}
+		dids[entry] = true
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", file.kind, err)
+	}
+	return dids, nil
+}
+
+// Watch reloads list files when they change on disk until ctx is cancelled, swapping the new
+// contents into every rule that uses them. A file that fails to load keeps its previous
+// contents. onChange is called after each successful reload.
+func (f *DIDFiles) Watch(ctx context.Context, onChange func()) error {
+	if len(f.files) == 0 {
+		return nil
+	}
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+
+	// Watch directories rather than files, since tools often replace a file by renaming a
+	// new one over it, which ends a watch on the file itself
+	byPath := make(map[string][]*didFile)
+	for _, file := range f.files {
+		if _, watched := byPath[file.path]; !watched {
+			if err := watcher.Add(filepath.Dir(file.path)); err != nil {
+				watcher.Close()
+				return err
+			}
+		}
+		byPath[file.path] = append(byPath[file.path], file)
+	}
+
+	go func() {
+		defer watcher.Close()
+		changed := make(map[string]bool)
+		var debounce <-chan time.Time
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if _, watched := byPath[event.Name]; watched && event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename) != 0 {
+					changed[event.Name] = true
+					debounce = time.After(didFileDebounce)
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				slog.Warn("Error watching DID list files", "error", err)
+			case <-debounce:
+				reloaded := false
+				for path := range changed {
+					for _, file := range byPath[path] {
+						dids, err := file.read()
+						if err != nil {
+							slog.Error("Failed to reload DID list, keeping the previous one", "kind", file.kind, "path", path, "error", err)
+							continue
+						}
+						file.set.dids.Store(&dids)
+						reloaded = true
+						slog.Info("Reloaded DID list", "kind", file.kind, "path", path, "count", len(dids))
+					}
+				}
+				clear(changed)
+				if reloaded && onChange != nil {
+					onChange()
+				}
+			}
+		}
+	}()
+	return nil
+}
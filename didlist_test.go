@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeDIDFile replaces path with the given lines the way editors and scripts usually do,
+// by renaming a finished file over it
+func writeDIDFile(t *testing.T, path string, lines []string) {
+	t.Helper()
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(strings.Join(lines, "\n")+"\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestDIDFilesShareAndReload loads a large list for two rules, checking they share one set
+// that follows edits to the file and survives an edit that doesn't parse
+func TestDIDFilesShareAndReload(t *testing.T) {
+	const count = 50000
+	dir := t.TempDir()
+	path := filepath.Join(dir, "authors.txt")
+	lines := []string{"# followed accounts", ""}
+	for i := 0; i < count; i++ {
+		lines = append(lines, fmt.Sprintf("did:plc:author%d", i))
+	}
+	writeDIDFile(t, path, lines)
+
+	files := NewDIDFiles()
+	first, err := files.Load("authorsFile", path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A second rule naming the same file by another path gets the same set
+	t.Chdir(dir)
+	second, err := files.Load("authorsFile", "authors.txt", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first != second {
+		t.Fatal("rules naming the same file got separate sets")
+	}
+	if n := len(first.All()); n != count {
+		t.Fatalf("loaded %d DIDs, want %d", n, count)
+	}
+
+	ruleA, ruleB := DIDList{first}, DIDList{NewDIDSet(map[string]bool{"did:plc:inline": true}), second}
+	for _, did := range []string{"did:plc:author0", fmt.Sprintf("did:plc:author%d", count-1)} {
+		if !ruleA.Contains(did) || !ruleB.Contains(did) {
+			t.Errorf("%s missing from a rule's list", did)
+		}
+	}
+	if ruleA.Contains("did:plc:inline") || !ruleB.Contains("did:plc:inline") {
+		t.Error("one rule's inline DIDs leaked into the shared set")
+	}
+	if ruleA.Contains("did:plc:stranger") {
+		t.Error("list contains a DID that isn't in the file")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	reloaded := make(chan struct{}, 1)
+	if err := files.Watch(ctx, func() { reloaded <- struct{}{} }); err != nil {
+		t.Fatal(err)
+	}
+
+	writeDIDFile(t, path, []string{"did:plc:newcomer"})
+	select {
+	case <-reloaded:
+	case <-time.After(10 * time.Second):
+		t.Fatal("list wasn't reloaded after the file changed")
+	}
+	if !ruleA.Contains("did:plc:newcomer") || !ruleB.Contains("did:plc:newcomer") {
+		t.Error("reloaded DID missing from a rule's list")
+	}
+	if ruleA.Contains("did:plc:author0") {
+		t.Error("DID removed from the file is still listed")
+	}
+
+	// An entry that isn't a DID fails the reload, which must leave the last good list in place
+	writeDIDFile(t, path, []string{"did:plc:other", "alice.bsky.social"})
+	select {
+	case <-reloaded:
+		t.Fatal("a list that doesn't parse was reported as reloaded")
+	case <-time.After(4 * didFileDebounce):
+	}
+	if !ruleA.Contains("did:plc:newcomer") || ruleA.Contains("did:plc:other") {
+		t.Error("failed reload replaced the previous list")
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// HealthStatus is the JSON body returned by /healthz
+type HealthStatus struct {
+	Status string `json:"status"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// lastEventTime holds the UnixNano time the firehose consumer last received an event
+var lastEventTime int64
+
+// eventsReceived counts events received from the firehose since startup
+var eventsReceived int64
+
+// MarkEventReceived records that the firehose consumer has just received an event
+func MarkEventReceived() {
+	atomic.StoreInt64(&lastEventTime, time.Now().UnixNano())
+	atomic.AddInt64(&eventsReceived, 1)
+}
+
+// CheckHealth reports whether the firehose is delivering events within the staleness window
+// and the job queue still has room. When unhealthy, the reason explains why.
+func CheckHealth(staleness time.Duration, queueLen, queueCap int) (bool, string) {
+	last := atomic.LoadInt64(&lastEventTime)
+	if last == 0 {
+		return false, "no events received from firehose yet"
+	}
+
+	since := time.Since(time.Unix(0, last))
+	if since > staleness {
+		return false, fmt.Sprintf("no events received from firehose in %s", since.Round(time.Second))
+	}
+
+	if queueCap > 0 && queueLen >= queueCap {
+		return false, fmt.Sprintf("job queue is full (%d/%d)", queueLen, queueCap)
+	}
+
+	return true, ""
+}
@@ -1,52 +1,573 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"math"
+	"slices"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/gorilla/websocket"
 )
 
+const (
+	clientSendBuffer = 256              // Frames queued per client before frames are dropped for it
+	writeWait        = 10 * time.Second // Time allowed to write a frame or ping to a client
+
+	// CloseQuotaExceeded is the websocket close code sent to a client that reached maxMessagesPerClient
+	CloseQuotaExceeded = 4029
+)
+
+// hubClient is a connected websocket or SSE client. Batched clients receive a JSON array of
+// BroadcastMessages per frame instead of one message per frame. Websocket clients have their
+// own writer goroutine fed by send, since gorilla allows only one writer per connection; SSE
+// clients are written by their request handler.
+type hubClient struct {
+	conn    *websocket.Conn // nil for SSE clients
+	batched bool
+	rules   map[string]bool // Rule and group names the client wants; nil means everything
+	send    chan []byte
+
+	received    int // Messages queued for the client so far, counted by the Hub's goroutine
+	closeCode   int // Set before send is closed when the Hub disconnects the client itself
+	closeReason string
+}
+
+// wants reports whether the client subscribed to any of a message's rules or groups
+func (c *hubClient) wants(msg hubMessage) bool {
+	if c.rules == nil {
+		return true
+	}
+	for _, name := range msg.names {
+		if c.rules[name] {
+			return true
+		}
+	}
+	return false
+}
+
+// Frame types: every frame sent to a client is an Envelope with one of these types, unless
+// the Hub sends legacy frames
+const (
+	FrameMatch     = "match"     // data is a BroadcastMessage
+	FrameReplay    = "replay"    // data is a BroadcastMessage marked as replayed (see startupGraceSeconds)
+	FrameHeartbeat = "heartbeat" // data is a Heartbeat
+	FrameInfo      = "info"      // data is a ConnectionInfo, sent once when the client connects
+	FrameStats     = "stats"     // data is a LiveStats, sent every pushStatsIntervalSeconds
+)
+
+// Envelope wraps each frame's payload with its type, so clients can tell matches from
+// heartbeats and connection info. Batched frames are an array of match and replay envelopes;
+// other frame types are always sent on their own.
+type Envelope struct {
+	Type string      `json:"type"`
+	Data interface{} `json:"data"`
+}
+
+// Heartbeat is sent periodically so clients that can't see websocket pings, such as browsers,
+// can tell a quiet stream from a dead one
+type Heartbeat struct {
+	Time time.Time `json:"time"`
+}
+
+// ConnectionInfo describes the stream a client just connected to
+type ConnectionInfo struct {
+	SchemaVersion int      `json:"schemaVersion"`
+	Rules         []string `json:"rules,omitempty"` // The rule and group names the client asked for; omitted for everything
+	Batched       bool     `json:"batched"`         // Whether match frames are arrays of envelopes
+}
+
+// LiveStats is a periodic summary of activity pushed to every client
+type LiveStats struct {
+	Time             time.Time          `json:"time"`
+	Clients          int                `json:"clients"`
+	EventsPerSecond  float64            `json:"eventsPerSecond"`  // Firehose events received, since the last push
+	MatchesPerSecond map[string]float64 `json:"matchesPerSecond"` // Per rule, since the last push
+	Counts           map[string]int64   `json:"counts"`           // Matches per rule since startup, as in /stats
+}
+
+// hubMessage is an encoded BroadcastMessage along with the rules and groups it matched
+type hubMessage struct {
+	data  []byte
+	names []string
+}
+
 type Hub struct {
-	clients    map[*websocket.Conn]bool
-	broadcast  chan []byte
-	register   chan *websocket.Conn
-	unregister chan *websocket.Conn
+	clients    map[*hubClient]bool
+	broadcast  chan hubMessage
+	register   chan *hubClient
+	unregister chan *hubClient
 	mu         sync.Mutex
+
+	quit    chan chan struct{} // Close asks Run to disconnect everyone, and is told when it has
+	closed  bool               // Set by Run once closing; later clients are turned away
+	writers sync.WaitGroup     // Running writePumps, so Close can wait for close frames to go out
+
+	// batchWindow is how long messages are coalesced for batched clients; 0 disables batching
+	batchWindow time.Duration
+	pending     []hubMessage
+
+	pingInterval time.Duration // How often the writer pings each client; 0 disables pings
+	readTimeout  time.Duration // Clients silent (no message or pong) for this long are disconnected; 0 disables
+	maxClients   int64         // 0 means unlimited
+	clientCount  int64         // Connected clients plus upgrades in progress, updated atomically
+	maxMessages  int           // Messages each connection may receive before it's closed; 0 means unlimited
+	envelope     bool          // Wrap frames in an Envelope; false sends bare BroadcastMessages
+}
+
+// HubOptions configures a Hub
+type HubOptions struct {
+	BatchWindow time.Duration // Coalescing window for batched clients; 0 disables batching
+	MaxClients  int           // Maximum concurrent clients; 0 means unlimited
+	IdleTimeout time.Duration // Disconnect clients that send nothing, not even a pong, for this long; 0 disables
+
+	// PingInterval overrides how often clients are pinged; by default it is half the idle timeout.
+	// Without an idle timeout, a client that doesn't answer a ping within PongWait is disconnected.
+	PingInterval time.Duration
+	PongWait     time.Duration
+
+	// MaxMessagesPerClient disconnects a client once it has been sent this many messages; 0 means unlimited
+	MaxMessagesPerClient int
+
+	// LegacyFrames sends bare BroadcastMessages instead of envelopes, with no heartbeat or info frames
+	LegacyFrames bool
 }
 
-func NewHub() *Hub {
-	return &Hub{
-		broadcast:  make(chan []byte),
-		register:   make(chan *websocket.Conn),
-		unregister: make(chan *websocket.Conn),
-		clients:    make(map[*websocket.Conn]bool),
+func NewHub(opts HubOptions) *Hub {
+	h := &Hub{
+		broadcast:    make(chan hubMessage),
+		register:     make(chan *hubClient),
+		unregister:   make(chan *hubClient),
+		quit:         make(chan chan struct{}),
+		clients:      make(map[*hubClient]bool),
+		batchWindow:  opts.BatchWindow,
+		pingInterval: opts.PingInterval,
+		readTimeout:  opts.IdleTimeout,
+		maxClients:   int64(opts.MaxClients),
+		maxMessages:  opts.MaxMessagesPerClient,
+		envelope:     !opts.LegacyFrames,
+	}
+	if h.pingInterval <= 0 && opts.IdleTimeout > 0 {
+		// Ping at half the timeout so a live client always has a chance to respond
+		h.pingInterval = opts.IdleTimeout / 2
+	}
+	if h.readTimeout <= 0 && h.pingInterval > 0 {
+		h.readTimeout = h.pingInterval + opts.PongWait
 	}
+	return h
 }
 
+// keepAlive arms the read deadline on a client connection. The deadline is pushed back
+// whenever the client sends anything, including the pongs answering the writer's pings.
+// It must be called before the connection's read loop starts.
+func (h *Hub) keepAlive(conn *websocket.Conn) {
+	if h.readTimeout <= 0 {
+		return
+	}
+	conn.SetReadDeadline(time.Now().Add(h.readTimeout))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(h.readTimeout))
+	})
+}
+
+// touch pushes back a client's idle deadline after it sends a message
+func (h *Hub) touch(conn *websocket.Conn) {
+	if h.readTimeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(h.readTimeout))
+	}
+}
+
+// AcquireSlot reserves room for a new client, returning false when the Hub is at capacity.
+// Reserving before the upgrade means a connection flood can't overshoot maxClients.
+func (h *Hub) AcquireSlot() bool {
+	for {
+		n := atomic.LoadInt64(&h.clientCount)
+		if h.maxClients > 0 && n >= h.maxClients {
+			return false
+		}
+		if atomic.CompareAndSwapInt64(&h.clientCount, n, n+1) {
+			return true
+		}
+	}
+}
+
+// ReleaseSlot frees a slot reserved by AcquireSlot
+func (h *Hub) ReleaseSlot() {
+	atomic.AddInt64(&h.clientCount, -1)
+}
+
+// ClientCount returns the number of connected clients, including upgrades in progress
+func (h *Hub) ClientCount() int {
+	return int(atomic.LoadInt64(&h.clientCount))
+}
+
+// Send implements Sink by broadcasting the match to every connected client that wants it, and
+// records how long the match took to get here
+func (h *Hub) Send(msg BroadcastMessage) {
+	var payload interface{} = msg
+	if h.envelope {
+		frameType := FrameMatch
+		if msg.Replay {
+			frameType = FrameReplay
+		}
+		payload = Envelope{Type: frameType, Data: msg}
+	}
+	data, err := json.Marshal(payload)
+	if err != nil {
+		slog.Error("Error marshaling broadcast message", "error", err)
+		return
+	}
+	h.broadcast <- hubMessage{data: data, names: slices.Concat(msg.MatchedRules, msg.MatchedGroups)}
+	GlobalLatency.Observe(msg.received, msg.produced, time.Now())
+}
+
+// Run is the Hub's event loop. It takes every broadcast as it arrives, whether or not any
+// clients are connected, and hands frames to clients without waiting on them, so a slow or
+// absent client never backs up the sink feeding the Hub.
 func (h *Hub) Run() {
+	// A nil channel never fires, so the flush case is inert when batching is off
+	var flush <-chan time.Time
+	if h.batchWindow > 0 {
+		ticker := time.NewTicker(h.batchWindow)
+		defer ticker.Stop()
+		flush = ticker.C
+	}
+
 	for {
 		select {
 		case client := <-h.register:
 			h.mu.Lock()
 			h.clients[client] = true
 			h.mu.Unlock()
+			if h.envelope {
+				h.greet(client)
+			}
+			if client.conn != nil {
+				h.writers.Add(1)
+				go h.writePump(client)
+			}
+			if h.closed {
+				h.mu.Lock()
+				h.goAway(client)
+				h.mu.Unlock()
+			}
 		case client := <-h.unregister:
 			h.mu.Lock()
-			if _, ok := h.clients[client]; ok {
-				delete(h.clients, client)
-				client.Close()
+			if h.clients[client] {
+				h.remove(client)
 			}
 			h.mu.Unlock()
 		case message := <-h.broadcast:
+			if h.batchWindow > 0 {
+				h.pending = append(h.pending, message)
+			}
+			h.write(message)
+		case <-flush:
+			if len(h.pending) == 0 {
+				continue
+			}
+			h.writeBatch(h.pending)
+			h.pending = h.pending[:0]
+		case done := <-h.quit:
+			if len(h.pending) > 0 {
+				h.writeBatch(h.pending)
+				h.pending = h.pending[:0]
+			}
+			h.closed = true
 			h.mu.Lock()
 			for client := range h.clients {
-				err := client.WriteMessage(websocket.TextMessage, message)
-				if err != nil {
-					client.Close()
-					delete(h.clients, client)
+				h.goAway(client)
+			}
+			h.mu.Unlock()
+			close(done)
+		}
+	}
+}
+
+// Close sends any batched messages still pending, then disconnects every client with a
+// going-away close frame once its queued frames are written. It waits for the websocket
+// writers to finish until ctx is done. Clients that connect afterwards are disconnected
+// straight away.
+func (h *Hub) Close(ctx context.Context) error {
+	done := make(chan struct{})
+	select {
+	case h.quit <- done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	<-done
+
+	written := make(chan struct{})
+	go func() {
+		h.writers.Wait()
+		close(written)
+	}()
+	select {
+	case <-written:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// goAway disconnects a client because the server is shutting down. The caller must hold h.mu.
+func (h *Hub) goAway(client *hubClient) {
+	client.closeCode, client.closeReason = websocket.CloseGoingAway, "server shutting down"
+	h.remove(client)
+}
+
+// greet queues the info frame for a newly registered client
+func (h *Hub) greet(client *hubClient) {
+	info := ConnectionInfo{
+		SchemaVersion: SchemaVersion,
+		Batched:       client.batched && h.batchWindow > 0,
+	}
+	for name := range client.rules {
+		info.Rules = append(info.Rules, name)
+	}
+	slices.Sort(info.Rules)
+	if frame, err := json.Marshal(Envelope{Type: FrameInfo, Data: info}); err == nil {
+		client.queue(frame)
+	}
+}
+
+// heartbeatFrame returns an encoded heartbeat envelope for the current time
+func heartbeatFrame() []byte {
+	frame, _ := json.Marshal(Envelope{Type: FrameHeartbeat, Data: Heartbeat{Time: time.Now().UTC()}})
+	return frame
+}
+
+// PushStats sends a stats frame to every client each interval until ctx is cancelled. Rates
+// cover the time since the previous push; pushes are skipped while no clients are connected.
+// Clients with a rules filter only get the counts of the rules they subscribed to, directly
+// or through the group each rule belongs to in groups.
+func (h *Hub) PushStats(ctx context.Context, interval time.Duration, groups map[string]string) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	last := time.Now()
+	lastEvents := atomic.LoadInt64(&eventsReceived)
+	lastCounts := GlobalRuleStats.GetCounts()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			events := atomic.LoadInt64(&eventsReceived)
+			counts := GlobalRuleStats.GetCounts()
+			elapsed := now.Sub(last).Seconds()
+			stats := LiveStats{
+				Time:             now.UTC(),
+				Clients:          h.ClientCount(),
+				EventsPerSecond:  perSecond(events-lastEvents, elapsed),
+				MatchesPerSecond: make(map[string]float64, len(counts)),
+				Counts:           counts,
+			}
+			for name, n := range counts {
+				stats.MatchesPerSecond[name] = perSecond(n-lastCounts[name], elapsed)
+			}
+			last, lastEvents, lastCounts = now, events, counts
+
+			if stats.Clients == 0 {
+				continue
+			}
+			var all []byte
+			h.mu.Lock()
+			for client := range h.clients {
+				if client.rules != nil {
+					if frame := statsFrame(stats.filtered(client.rules, groups)); frame != nil {
+						client.queue(frame)
+					}
+					continue
+				}
+				if all == nil {
+					all = statsFrame(stats)
+				}
+				if all != nil {
+					client.queue(all)
 				}
 			}
 			h.mu.Unlock()
 		}
 	}
 }
+
+// statsFrame encodes a stats envelope, or returns nil if it can't be encoded
+func statsFrame(stats LiveStats) []byte {
+	frame, err := json.Marshal(Envelope{Type: FrameStats, Data: stats})
+	if err != nil {
+		slog.Error("Error marshaling stats frame", "error", err)
+		return nil
+	}
+	return frame
+}
+
+// filtered returns a copy of the stats with only the per-rule figures of rules named in
+// names, or belonging to a group named in it. Firehose-wide figures are kept as they are.
+func (s LiveStats) filtered(names map[string]bool, groups map[string]string) LiveStats {
+	counts := s.Counts
+	s.Counts = make(map[string]int64)
+	for name, n := range counts {
+		if names[name] || names[groups[name]] {
+			s.Counts[name] = n
+		}
+	}
+	rates := s.MatchesPerSecond
+	s.MatchesPerSecond = make(map[string]float64)
+	for name, rate := range rates {
+		if names[name] || names[groups[name]] {
+			s.MatchesPerSecond[name] = rate
+		}
+	}
+	return s
+}
+
+// perSecond returns a rate rounded to hundredths, which is as precise as a readout needs
+func perSecond(n int64, seconds float64) float64 {
+	return math.Round(float64(n)/seconds*100) / 100
+}
+
+// write queues a single-message frame for every unbatched client that wants it. When batching
+// is off, batched clients get single-message frames like everyone else.
+func (h *Hub) write(message hubMessage) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for client := range h.clients {
+		if client.batched && h.batchWindow > 0 {
+			continue
+		}
+		if client.wants(message) {
+			h.deliver(client, message.data, 1)
+		}
+	}
+}
+
+// writeBatch queues a window's messages as one frame for every batched client. Clients that
+// want everything share one frame; filtered clients get a frame of just their messages.
+func (h *Hub) writeBatch(messages []hubMessage) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var all []byte
+	for client := range h.clients {
+		if !client.batched {
+			continue
+		}
+		if client.rules == nil {
+			if all == nil {
+				all, _ = batchFrame(messages, nil)
+			}
+			h.deliver(client, all, len(messages))
+			continue
+		}
+		if frame, n := batchFrame(messages, client); frame != nil {
+			h.deliver(client, frame, n)
+		}
+	}
+}
+
+// deliver queues a frame of n messages for a client, disconnecting it once it reaches
+// maxMessages. A batched frame that crosses the limit is still delivered whole. The caller
+// must hold h.mu.
+func (h *Hub) deliver(client *hubClient, frame []byte, n int) {
+	if !client.queue(frame) {
+		return
+	}
+	client.received += n
+	if h.maxMessages > 0 && client.received >= h.maxMessages {
+		client.closeCode, client.closeReason = CloseQuotaExceeded, "message quota exceeded"
+		h.remove(client)
+		slog.Debug("Client reached its message quota, disconnecting", "messages", client.received)
+	}
+}
+
+// remove stops sending to a client and frees its slot. Its writer sends whatever is still
+// queued, then closes the connection. The caller must hold h.mu.
+func (h *Hub) remove(client *hubClient) {
+	delete(h.clients, client)
+	close(client.send)
+	h.ReleaseSlot()
+}
+
+// queue hands a frame to the client's writer, reporting whether it was queued. A client whose
+// queue is full misses the frame rather than stalling everyone else.
+func (c *hubClient) queue(frame []byte) bool {
+	select {
+	case c.send <- frame:
+		return true
+	default:
+		GlobalDropStats.Increment("websocketClient")
+		return false
+	}
+}
+
+// writePump is the only goroutine that writes to a client's connection. It sends queued
+// frames and periodic pings, and closes the connection when the client is unregistered or
+// a write fails; the failed write also ends the read loop, which unregisters the client.
+func (h *Hub) writePump(client *hubClient) {
+	var ping <-chan time.Time
+	if h.pingInterval > 0 {
+		ticker := time.NewTicker(h.pingInterval)
+		defer ticker.Stop()
+		ping = ticker.C
+	}
+	defer h.writers.Done()
+	defer client.conn.Close()
+
+	for {
+		select {
+		case frame, ok := <-client.send:
+			client.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if !ok {
+				var closeMsg []byte
+				if client.closeCode != 0 {
+					closeMsg = websocket.FormatCloseMessage(client.closeCode, client.closeReason)
+				}
+				client.conn.WriteMessage(websocket.CloseMessage, closeMsg)
+				return
+			}
+			if err := client.conn.WriteMessage(websocket.TextMessage, frame); err != nil {
+				return
+			}
+		case <-ping:
+			client.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := client.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+			// Browsers never see pings, so envelope clients also get a heartbeat they can watch for
+			if h.envelope {
+				if err := client.conn.WriteMessage(websocket.TextMessage, heartbeatFrame()); err != nil {
+					return
+				}
+			}
+		}
+	}
+}
+
+// batchFrame joins already-encoded messages into a single JSON array, keeping only those the
+// client wants when one is given, and returns it with the number of messages kept. It returns
+// nil if no messages are kept.
+func batchFrame(messages []hubMessage, client *hubClient) ([]byte, int) {
+	var buf bytes.Buffer
+	kept := 0
+	for _, message := range messages {
+		if client != nil && !client.wants(message) {
+			continue
+		}
+		if buf.Len() == 0 {
+			buf.WriteByte('[')
+		} else {
+			buf.WriteByte(',')
+		}
+		buf.Write(message.data)
+		kept++
+	}
+	if buf.Len() == 0 {
+		return nil, 0
+	}
+	buf.WriteByte(']')
+	return buf.Bytes(), kept
+}
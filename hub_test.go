@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// BenchmarkHubBatching broadcasts matches to websocket clients over loopback, once with a
+// frame per match and once with matches coalesced into batched frames, reporting the frames
+// each match cost and how many were dropped for clients that fell behind
+func BenchmarkHubBatching(b *testing.B) {
+	for _, bench := range []struct {
+		name  string
+		query string
+	}{
+		{"perMessage", ""},
+		{"batched", "?batch=1"},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			benchmarkHub(b, bench.query, 8)
+		})
+	}
+}
+
+func benchmarkHub(b *testing.B, query string, clients int) {
+	hub := NewHub(HubOptions{BatchWindow: 5 * time.Millisecond})
+	go hub.Run()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serveWs(hub, nil, w, r)
+	}))
+	defer srv.Close()
+
+	var frames int64
+	var readers sync.WaitGroup
+	for i := 0; i < clients; i++ {
+		conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+query, nil)
+		if err != nil {
+			b.Fatal(err)
+		}
+		defer conn.Close()
+		// The info frame comes once the Hub has registered the client
+		if _, _, err := conn.ReadMessage(); err != nil {
+			b.Fatal(err)
+		}
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			for {
+				if _, _, err := conn.ReadMessage(); err != nil {
+					return
+				}
+				atomic.AddInt64(&frames, 1)
+			}
+		}()
+	}
+
+	msg := BroadcastMessage{SchemaVersion: SchemaVersion, MatchedRules: []string{"bench"}, Event: map[string]string{"text": "hello world"}}
+	dropsBefore := GlobalDropStats.GetCounts()["websocketClient"]
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		hub.Send(msg)
+	}
+	// Closing flushes the last batch and waits for every client to be sent its frames
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	if err := hub.Close(ctx); err != nil {
+		b.Fatal(err)
+	}
+	readers.Wait()
+	b.StopTimer()
+
+	perClient := float64(b.N) * float64(clients)
+	b.ReportMetric(float64(atomic.LoadInt64(&frames))/perClient, "frames/msg")
+	b.ReportMetric(float64(GlobalDropStats.GetCounts()["websocketClient"]-dropsBefore)/perClient, "dropped/msg")
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/TheAlyxGreen/firefly"
+	"github.com/bluesky-social/indigo/api/bsky"
+	"github.com/bluesky-social/jetstream/pkg/models"
+)
+
+// ParseJetstreamEvent converts a raw Jetstream JSON message into a FirehoseEvent the same way
+// firefly does for the live stream, so events from other sources (pasted test events, replays)
+// are matched exactly like firehose events. client is only used to build blob URLs for embeds.
+func ParseJetstreamEvent(client *firefly.Firefly, data []byte) (*firefly.FirehoseEvent, error) {
+	var raw models.Event
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal jetstream message: %w", err)
+	}
+	if raw.Did == "" {
+		return nil, fmt.Errorf("jetstream message has no did")
+	}
+
+	event := &firefly.FirehoseEvent{
+		Type:      firefly.EventTypeUnknown,
+		Sequence:  raw.TimeUS,
+		Repo:      raw.Did,
+		Timestamp: time.Unix(0, raw.TimeUS*1000),
+		RawCommit: &raw,
+	}
+
+	switch raw.Kind {
+	case "commit":
+		if raw.Commit == nil {
+			return nil, fmt.Errorf("commit event missing commit data")
+		}
+		return event, parseCommit(client, event, raw.Commit)
+	case "identity":
+		if raw.Identity == nil {
+			return nil, fmt.Errorf("identity event missing identity data")
+		}
+		identity := &firefly.FirehoseIdentity{DID: raw.Identity.Did, Seq: raw.Identity.Seq}
+		if raw.Identity.Handle != nil {
+			identity.Handle = *raw.Identity.Handle
+		}
+		if t, err := time.Parse(time.RFC3339, raw.Identity.Time); err == nil {
+			identity.Time = t
+		}
+		event.Type = firefly.EventTypeIdentity
+		event.IdentityEvent = identity
+		event.User = &firefly.User{Did: identity.DID, Handle: identity.Handle}
+	case "account":
+		if raw.Account == nil {
+			return nil, fmt.Errorf("account event missing account data")
+		}
+		account := &firefly.FirehoseAccount{DID: raw.Account.Did, Active: raw.Account.Active, Seq: raw.Account.Seq}
+		if raw.Account.Status != nil {
+			account.Status = *raw.Account.Status
+		}
+		if t, err := time.Parse(time.RFC3339, raw.Account.Time); err == nil {
+			account.Time = t
+		}
+		event.Type = firefly.EventTypeAccount
+		event.AccountEvent = account
+		event.User = &firefly.User{Did: account.DID}
+	}
+	return event, nil
+}
+
+// parseCommit fills in the typed fields for the record collections firefly understands.
+// Other collections stay EventTypeUnknown and are matched on their raw commit.
+func parseCommit(client *firefly.Firefly, event *firefly.FirehoseEvent, commit *models.Commit) error {
+	uri := fmt.Sprintf("at://%s/%s/%s", event.Repo, commit.Collection, commit.RKey)
+
+	switch commit.Collection {
+	case "app.bsky.feed.post", "app.bsky.feed.like", "app.bsky.feed.repost", "app.bsky.graph.follow":
+	default:
+		return nil
+	}
+
+	if commit.Operation == "delete" {
+		event.Type = firefly.EventTypeDelete
+		event.DeleteEvent = &firefly.FirehoseDelete{
+			Collection: commit.Collection,
+			RecordKey:  commit.RKey,
+			URI:        uri,
+		}
+		return nil
+	}
+	if commit.Record == nil {
+		return fmt.Errorf("%s event missing record data", commit.Collection)
+	}
+
+	switch commit.Collection {
+	case "app.bsky.feed.post":
+		var record bsky.FeedPost
+		if err := json.Unmarshal(commit.Record, &record); err != nil {
+			return fmt.Errorf("failed to unmarshal post record: %w", err)
+		}
+		// Firefly only accepts RFC 3339 timestamps, so normalize the ones clients get slightly
+		// wrong. A post whose createdAt can't be parsed at all is kept without one.
+		createdAt, dated := parseCreatedAt(record.CreatedAt)
+		if !dated {
+			createdAt = event.Timestamp
+		}
+		record.CreatedAt = createdAt.Format(time.RFC3339Nano)
+		post, err := client.OldToNewPost(&record, event.Repo)
+		if err != nil {
+			return fmt.Errorf("failed to convert post: %w", err)
+		}
+		if !dated {
+			post.CreatedAt = nil
+		}
+		post.URI = uri
+		post.CID = commit.CID
+		event.Type = firefly.EventTypePost
+		event.Post = post
+	case "app.bsky.feed.like", "app.bsky.feed.repost":
+		var record struct {
+			Subject firefly.PostRef `json:"subject"`
+		}
+		if err := json.Unmarshal(commit.Record, &record); err != nil {
+			return fmt.Errorf("failed to unmarshal %s record: %w", commit.Collection, err)
+		}
+		if commit.Collection == "app.bsky.feed.like" {
+			event.Type = firefly.EventTypeLike
+			event.LikeEvent = &firefly.FirehoseLike{Subject: &record.Subject, URI: uri}
+		} else {
+			event.Type = firefly.EventTypeRepost
+			event.RepostEvent = &firefly.FirehoseRepost{Subject: &record.Subject, URI: uri}
+		}
+	case "app.bsky.graph.follow":
+		var record struct {
+			Subject string `json:"subject"`
+		}
+		if err := json.Unmarshal(commit.Record, &record); err != nil {
+			return fmt.Errorf("failed to unmarshal follow record: %w", err)
+		}
+		event.Type = firefly.EventTypeFollow
+		event.User = &firefly.User{Did: record.Subject}
+	}
+	return nil
+}
+
+// createdAtLayouts are the timestamp formats accepted in a post's createdAt, tried in order.
+// Records should use RFC 3339, but some clients omit the timezone or use a space separator.
+var createdAtLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02 15:04:05.999999999Z07:00",
+	"2006-01-02 15:04:05.999999999",
+}
+
+// parseCreatedAt parses a record's createdAt, treating timestamps without a timezone as UTC.
+// ok is false when it matches none of createdAtLayouts.
+func parseCreatedAt(s string) (t time.Time, ok bool) {
+	s = strings.TrimSpace(s)
+	for _, layout := range createdAtLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"slices"
+	"sync"
+	"time"
+)
+
+// latencySamples is how many recent broadcasts each latency series keeps for its percentiles
+const latencySamples = 1024
+
+// LatencyStats summarizes a latency series in milliseconds
+type LatencyStats struct {
+	Count int64   `json:"count"` // Broadcasts observed since server start
+	P50   float64 `json:"p50Ms"`
+	P90   float64 `json:"p90Ms"`
+	P99   float64 `json:"p99Ms"`
+	Max   float64 `json:"maxMs"`
+}
+
+// latencySeries keeps the most recent durations in a ring, so percentiles reflect current
+// conditions rather than everything since startup
+type latencySeries struct {
+	samples [latencySamples]time.Duration
+	next    int
+	count   int64
+}
+
+func (s *latencySeries) observe(d time.Duration) {
+	s.samples[s.next] = d
+	s.next = (s.next + 1) % latencySamples
+	s.count++
+}
+
+func (s *latencySeries) stats() *LatencyStats {
+	if s.count == 0 {
+		return nil
+	}
+	n := int(min(s.count, latencySamples))
+	sorted := slices.Clone(s.samples[:n])
+	slices.Sort(sorted)
+	ms := func(q float64) float64 {
+		d := sorted[int(q*float64(n-1))]
+		return float64(d.Microseconds()) / 1000
+	}
+	return &LatencyStats{Count: s.count, P50: ms(0.5), P90: ms(0.9), P99: ms(0.99), Max: ms(1)}
+}
+
+// LatencyTracker records how long matches take to reach the client hub
+type LatencyTracker struct {
+	mu       sync.Mutex
+	pipeline latencySeries // Firehose arrival to broadcast
+	endToEnd latencySeries // The event's time_us to broadcast, including upstream lag
+}
+
+// LatencySnapshot is the latency section of /stats
+type LatencySnapshot struct {
+	Pipeline *LatencyStats `json:"pipeline,omitempty"`
+	EndToEnd *LatencyStats `json:"endToEnd,omitempty"`
+}
+
+// GlobalLatency tracks broadcast latency for /stats
+var GlobalLatency = &LatencyTracker{}
+
+// Observe records a broadcast made at now of an event received at received and produced
+// upstream at produced. Zero times, as on synthetic test broadcasts, are skipped.
+func (t *LatencyTracker) Observe(received, produced, now time.Time) {
+	if received.IsZero() && produced.IsZero() {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !received.IsZero() {
+		t.pipeline.observe(now.Sub(received))
+	}
+	if !produced.IsZero() {
+		t.endToEnd.observe(now.Sub(produced))
+	}
+}
+
+// Snapshot returns percentiles over the most recent broadcasts, or nil before the first one
+func (t *LatencyTracker) Snapshot() *LatencySnapshot {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.pipeline.count == 0 && t.endToEnd.count == 0 {
+		return nil
+	}
+	return &LatencySnapshot{Pipeline: t.pipeline.stats(), EndToEnd: t.endToEnd.stats()}
+}
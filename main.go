@@ -1,275 +1,1155 @@
 package main
 
 import (
+	"cmp"
 	"context"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
-	"log"
+	"log/slog"
+	"net"
 	"net/http"
-	"regexp"
-	"runtime"
+	"net/http/pprof"
+	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/TheAlyxGreen/firefly"
 	"github.com/gorilla/websocket"
 )
 
-var upgrader = websocket.Upgrader{
-	ReadBufferSize:  1024,
-	WriteBufferSize: 1024,
-	CheckOrigin: func(r *http.Request) bool {
-		return true // Allow all origins for now
-	},
-}
+// shutdownTimeout bounds how long shutdown waits for queued events, sink deliveries, client
+// close frames, and in-flight HTTP requests, all together
+const shutdownTimeout = 10 * time.Second
+
+// upgrader's CheckOrigin and buffer sizes are set from the config at startup
+var upgrader websocket.Upgrader
 
 // PublicConfig exposes safe configuration to the client
 type PublicConfig struct {
 	BskyServer string `json:"bskyServer"`
+
+	// BroadcastBatchMillis is the batching window for clients connecting with ?batch=1; 0 means batching is off
+	BroadcastBatchMillis int `json:"broadcastBatchMillis"`
+
+	// SchemaVersion is the version of the broadcast message format, so clients can check it before connecting
+	SchemaVersion int `json:"schemaVersion"`
+
+	// LegacyFrames is true when frames are bare messages rather than envelopes
+	LegacyFrames bool `json:"legacyFrames,omitempty"`
+}
+
+// RuleInfo describes a compiled rule for clients. It is derived from the compiled rules
+// so only matching metadata is exposed.
+type RuleInfo struct {
+	Name        string     `json:"name"`
+	Collections []string   `json:"collections"`
+	Langs       []string   `json:"langs"`
+	EmbedTypes  []string   `json:"embedTypes"`
+	IsReply     *bool      `json:"isReply,omitempty"`
+	Tags        []string   `json:"tags,omitempty"`
+	Priority    int        `json:"priority"`
+	LastMatched *time.Time `json:"lastMatched,omitempty"`
 }
 
 func main() {
+	configFlag := flag.String("config", "config.json", "Comma-separated config files, merged in order")
+	debugFlag := flag.Bool("debug", false, "Log at debug level and log why sampled events didn't match each rule")
+	checkFlag := flag.Bool("check", false, "Validate the config and compile its rules, print a summary, and exit")
+	sampleFlag := flag.Bool("sample", false, "Print one event of each collection from the firehose as JSON, then exit")
+	flag.Parse()
+
 	// 1. Load Configuration
-	config, err := LoadConfig("config.json")
+	config, err := LoadConfig(*configFlag)
 	if err != nil {
-		log.Fatalf("Failed to load config: %v", err)
+		fatal("Failed to load config", "error", err)
+	}
+	loaded := *config // As in the file, before flags and defaults below change it, for reloadRule
+	if *debugFlag {
+		config.LogLevel = "debug"
+	}
+	if err := SetupLogger(config.LogLevel, config.LogFormat); err != nil {
+		fatal("Invalid logging config", "error", err)
+	}
+	if config.CursorLookback != "" {
+		if config.CursorOffset != 0 {
+			slog.Warn("Both cursorOffset and cursorLookback are set, using cursorOffset", "cursorOffset", config.CursorOffset, "cursorLookback", config.CursorLookback)
+		} else {
+			config.CursorOffset, _ = ParseLookback(config.CursorLookback) // Validated by LoadConfig
+		}
+	}
+
+	servers := config.JetstreamServers
+	if len(servers) == 0 && config.JetstreamServer != "" {
+		servers = []string{config.JetstreamServer}
 	}
 
-	// 2. Compile Rules and Aggregate Collections/Authors
+	if *sampleFlag {
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		client, err := firefly.NewCustomInstance(ctx, config.BskyServer, new(http.Client))
+		if err != nil {
+			fatal("Error creating firefly client", "server", config.BskyServer, "error", err)
+		}
+		consumer, err := NewJetstreamConsumer(client, JetstreamOptions{Servers: servers, Compress: config.JetstreamCompress})
+		if err != nil {
+			fatal("Error creating Jetstream consumer", "error", err)
+		}
+		if err := RunSample(ctx, consumer); err != nil {
+			fatal("Sampling failed", "error", err)
+		}
+		return
+	}
+
+	// 2. Compile Rules
 	var compiledRules []CompiledRuleSet
-	collectionsMap := make(map[string]bool)
-	authorsMap := make(map[string]bool)
-	var ruleNames []string
-	subscribeToAllCollections := false
-	subscribeToAllAuthors := false
+	needProfiles := false // Whether any rule filters on author profiles
+	needSubjects := false // Whether any rule matches reposted or quoted posts' text
 
-	// If no rules are defined, we default to subscribing to everything (or nothing, but let's assume everything for authors)
-	if len(config.Rules) == 0 {
-		subscribeToAllAuthors = true
+	// Broadcasts carry a score once minScore or any rule's weight is set
+	scoring := config.MinScore != 0
+
+	// Largest regex program per rule, reported by -check
+	largestRegex := make(map[string]int)
+
+	// Handles in TargetUsers, TargetInvolved, and QuoteTargets are resolved once at load; the DID is the stable identifier
+	resolvedHandles := make(map[string]string)
+	var resolvedMu sync.Mutex // Target list files may be reloaded in the background
+	resolveTarget := func(target string) (string, error) {
+		if strings.HasPrefix(target, "did:") {
+			return target, nil
+		}
+		resolvedMu.Lock()
+		defer resolvedMu.Unlock()
+		if did, ok := resolvedHandles[target]; ok {
+			return did, nil
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		did, err := ResolveHandleToDID(ctx, config.BskyServer, target)
+		if err != nil {
+			return "", fmt.Errorf("failed to resolve target user handle %q: %w", target, err)
+		}
+		slog.Info("Resolved target user", "handle", target, "did", did)
+		resolvedHandles[target] = did
+		return did, nil
 	}
 
-	for i, rule := range config.Rules {
+	origins, err := NewOriginPolicy(config.AllowedOrigins)
+	if err != nil {
+		fatal("Invalid allowedOrigins", "error", err)
+	}
+	upgrader.CheckOrigin = origins.CheckOrigin
+	upgrader.ReadBufferSize = config.WsReadBufferSize
+	upgrader.WriteBufferSize = config.WsWriteBufferSize
+
+	normalizer, err := NewTextNormalizer(config.TextNormalization)
+	if err != nil {
+		fatal("Invalid textNormalization", "error", err)
+	}
+	if config.FoldConfusables {
+		normalizer = append(normalizer, FoldConfusables)
+	}
+	if len(normalizer) > 0 {
+		slog.Info("Normalizing post text before matching", "textNormalization", config.TextNormalization, "foldConfusables", config.FoldConfusables)
+	}
+
+	// Author list files are loaded once and shared by every rule that names them
+	didFiles := NewDIDFiles()
+
+	// compileRule builds a rule from its config. It is also used to reload a single rule from
+	// the config file while running, so it returns errors rather than exiting.
+	compileRule := func(i int, rule RuleSet) (*CompiledRuleSet, error) {
 		var cr CompiledRuleSet
-		cr.Name = rule.Name
-		if cr.Name == "" {
-			cr.Name = fmt.Sprintf("Rule #%d", i+1)
-		}
-		ruleNames = append(ruleNames, cr.Name)
+		cr.Name = ruleName(i, rule)
+		cr.Group = rule.Group
+		cr.Priority = rule.Priority
+		cr.StopOnMatch = rule.StopOnFirstMatch
 
 		// Collections
 		cr.Collections = rule.Collections
-		for _, c := range rule.Collections {
-			if c == "*" {
-				subscribeToAllCollections = true
+		if len(rule.Collections) == 0 && (len(rule.Authors) > 0 || rule.AuthorsFile != "") && len(config.DefaultCollections) > 0 {
+			cr.Collections = config.DefaultCollections
+			slog.Info("Rule names authors but no collections, using defaultCollections", "rule", cr.Name, "collections", cr.Collections)
+		}
+		for _, c := range cr.Collections {
+			// Jetstream subscriptions can't glob, so globs subscribe to everything and filter locally
+			if IsCollectionGlob(c) && c != "*" {
+				slog.Info("Collection glob forces subscription to all collections", "rule", cr.Name, "collection", c)
 			}
-			collectionsMap[c] = true
+		}
+
+		// Dedicated Stream
+		if rule.CursorLookback != "" {
+			if rule.CursorOffset != nil {
+				slog.Warn("Both cursorOffset and cursorLookback are set, using cursorOffset", "rule", cr.Name, "cursorOffset", *rule.CursorOffset, "cursorLookback", rule.CursorLookback)
+			} else {
+				offset, _ := ParseLookback(rule.CursorLookback) // Validated by LoadConfig
+				rule.CursorOffset = &offset
+			}
+		}
+		if rule.CursorOffset != nil {
+			if *rule.CursorOffset < 0 {
+				return nil, fmt.Errorf("rule %q: cursorOffset must not be negative", cr.Name)
+			}
+			cr.CursorOffset = rule.CursorOffset
 		}
 
 		// Compile Text Regexes
 		for _, r := range rule.TextRegexes {
-			compiled, err := regexp.Compile(r)
+			compiled, size, err := CompileRulePattern(r, config.MaxRegexProgramSize)
 			if err != nil {
-				log.Fatalf("Invalid text regex '%s' in rule '%s': %v", r, cr.Name, err)
+				return nil, fmt.Errorf("rule %q: invalid text regex %q: %w", cr.Name, r, err)
 			}
+			largestRegex[cr.Name] = max(largestRegex[cr.Name], size)
 			cr.TextPatterns = append(cr.TextPatterns, compiled)
+			cr.TextPrefilters = append(cr.TextPrefilters, RequiredLiteral(r))
+		}
+		cr.CombinedText = CombinePatterns(rule.TextRegexes)
+		if rule.CaptureGroups {
+			cr.CaptureGroups = true
+			if !slices.ContainsFunc(cr.TextPatterns, hasNamedGroups) {
+				slog.Warn("captureGroups is set but no textRegexes have named groups", "rule", cr.Name)
+			}
 		}
 
 		// Compile URL Regexes
 		for _, r := range rule.UrlRegexes {
-			compiled, err := regexp.Compile(r)
+			compiled, size, err := CompileRulePattern(r, config.MaxRegexProgramSize)
 			if err != nil {
-				log.Fatalf("Invalid url regex '%s' in rule '%s': %v", r, cr.Name, err)
+				return nil, fmt.Errorf("rule %q: invalid url regex %q: %w", cr.Name, r, err)
 			}
+			largestRegex[cr.Name] = max(largestRegex[cr.Name], size)
 			cr.UrlPatterns = append(cr.UrlPatterns, compiled)
 		}
 
+		cr.MaxVideoSeconds = rule.MaxVideoSeconds
+		cr.VideoAspect = rule.VideoAspect
+		cr.AltTextSource = rule.AltTextSource
+
+		// Compile Alt Text Regexes
+		for _, r := range rule.AltTextRegexes {
+			compiled, size, err := CompileRulePattern(r, config.MaxRegexProgramSize)
+			if err != nil {
+				return nil, fmt.Errorf("rule %q: invalid alt text regex %q: %w", cr.Name, r, err)
+			}
+			largestRegex[cr.Name] = max(largestRegex[cr.Name], size)
+			cr.AltTextPatterns = append(cr.AltTextPatterns, compiled)
+		}
+
+		// Compile External Link Title/Description Regexes
+		for _, r := range rule.ExternalTitleRegexes {
+			compiled, size, err := CompileRulePattern(r, config.MaxRegexProgramSize)
+			if err != nil {
+				return nil, fmt.Errorf("rule %q: invalid external title regex %q: %w", cr.Name, r, err)
+			}
+			largestRegex[cr.Name] = max(largestRegex[cr.Name], size)
+			cr.ExternalTitlePatterns = append(cr.ExternalTitlePatterns, compiled)
+		}
+		for _, r := range rule.ExternalDescRegexes {
+			compiled, size, err := CompileRulePattern(r, config.MaxRegexProgramSize)
+			if err != nil {
+				return nil, fmt.Errorf("rule %q: invalid external description regex %q: %w", cr.Name, r, err)
+			}
+			largestRegex[cr.Name] = max(largestRegex[cr.Name], size)
+			cr.ExternalDescPatterns = append(cr.ExternalDescPatterns, compiled)
+		}
+
+		// Compile Subject Text Regexes
+		for _, r := range rule.SubjectTextRegexes {
+			compiled, size, err := CompileRulePattern(r, config.MaxRegexProgramSize)
+			if err != nil {
+				return nil, fmt.Errorf("rule %q: invalid subject text regex %q: %w", cr.Name, r, err)
+			}
+			largestRegex[cr.Name] = max(largestRegex[cr.Name], size)
+			cr.SubjectTextPatterns = append(cr.SubjectTextPatterns, compiled)
+		}
+
 		// Authors (Exact Match)
 		if len(rule.Authors) > 0 {
-			cr.Authors = make(map[string]bool)
+			inline := make(map[string]bool)
 			for _, author := range rule.Authors {
-				cr.Authors[author] = true
-				authorsMap[author] = true
+				inline[author] = true
 			}
-		} else {
-			// If a rule has no specific authors, it needs to listen to ALL authors
-			subscribeToAllAuthors = true
+			cr.Authors = append(cr.Authors, NewDIDSet(inline))
+		}
+		if rule.AuthorsFile != "" {
+			set, err := didFiles.Load("authorsFile", rule.AuthorsFile, nil)
+			if err != nil {
+				return nil, fmt.Errorf("rule %q: failed to load authors file: %w", cr.Name, err)
+			}
+			cr.Authors = append(cr.Authors, set)
 		}
 
 		// Target Users (Exact Match)
 		if len(rule.TargetUsers) > 0 {
-			cr.TargetUsers = make(map[string]bool)
+			inline := make(map[string]bool)
 			for _, target := range rule.TargetUsers {
-				cr.TargetUsers[target] = true
+				did, err := resolveTarget(target)
+				if err != nil {
+					return nil, fmt.Errorf("rule %q: %w", cr.Name, err)
+				}
+				inline[did] = true
+			}
+			cr.TargetUsers = append(cr.TargetUsers, NewDIDSet(inline))
+		}
+		if rule.TargetUsersFile != "" {
+			set, err := didFiles.Load("targetUsersFile", rule.TargetUsersFile, resolveTarget)
+			if err != nil {
+				return nil, fmt.Errorf("rule %q: failed to load target users file: %w", cr.Name, err)
 			}
+			cr.TargetUsers = append(cr.TargetUsers, set)
 		}
 
+		// Target Involved (any way the event points at the account)
+		if len(rule.TargetInvolved) > 0 {
+			inline := make(map[string]bool)
+			for _, target := range rule.TargetInvolved {
+				did, err := resolveTarget(target)
+				if err != nil {
+					return nil, fmt.Errorf("rule %q: %w", cr.Name, err)
+				}
+				inline[did] = true
+			}
+			cr.TargetInvolved = append(cr.TargetInvolved, NewDIDSet(inline))
+		}
+
+		// Quote Targets (the quoted post's author)
+		if len(rule.QuoteTargets) > 0 {
+			inline := make(map[string]bool)
+			for _, target := range rule.QuoteTargets {
+				did, err := resolveTarget(target)
+				if err != nil {
+					return nil, fmt.Errorf("rule %q: %w", cr.Name, err)
+				}
+				inline[did] = true
+			}
+			cr.QuoteTargets = append(cr.QuoteTargets, NewDIDSet(inline))
+		}
+
+		cr.TargetCollections = rule.TargetCollections
+
+		for _, op := range rule.Operations {
+			if op != "create" && op != "update" && op != "delete" {
+				return nil, fmt.Errorf("rule %q: invalid operation %q, expected create, update, or delete", cr.Name, op)
+			}
+		}
+		cr.Operations = rule.Operations
+		cr.AccountStatuses = rule.AccountStatuses
+		cr.IdentityChanges = rule.IdentityChanges
+
 		// Embed Types & Langs & IsReply
 		cr.EmbedTypes = rule.EmbedTypes
+		cr.HasEmbed = rule.HasEmbed
+
+		// Mention & Link Counts
+		cr.MinMentions, cr.MaxMentions = rule.MinMentions, rule.MaxMentions
+		cr.MinLinks, cr.MaxLinks = rule.MinLinks, rule.MaxLinks
 		cr.Langs = rule.Langs
 		cr.IsReply = rule.IsReply
 
-		compiledRules = append(compiledRules, cr)
-	}
-	log.Printf("Loaded %d rule sets", len(compiledRules))
+		// Reply Depth
+		if rule.MinReplyDepth != nil {
+			if *rule.MinReplyDepth > 2 {
+				slog.Warn("Only reply depths up to 2 can be detected, treating minReplyDepth as 2", "rule", cr.Name, "minReplyDepth", *rule.MinReplyDepth)
+			}
+			cr.MinReplyDepth = rule.MinReplyDepth
+		}
+		cr.SelfReplyOnly = rule.SelfReplyOnly
+		cr.HasThreadgate, cr.ThreadgateType = rule.HasThreadgate, rule.ThreadgateType
 
-	// Determine Collections to subscribe to
-	var collections []string
-	if !subscribeToAllCollections {
-		for c := range collectionsMap {
-			// Exclude pseudo-collections used for internal filtering
-			if c != "identity" && c != "account" {
-				collections = append(collections, c)
+		// Time-of-Day Window
+		if rule.TimeWindowStart != "" || rule.TimeWindowEnd != "" {
+			tw, err := ParseTimeWindow(rule.TimeWindowStart, rule.TimeWindowEnd, rule.Timezone)
+			if err != nil {
+				return nil, fmt.Errorf("rule %q: invalid time window: %w", cr.Name, err)
 			}
+			cr.TimeWindow = tw
+		}
+
+		// Clock Skew
+		if rule.MaxClockSkewSeconds != nil {
+			d := time.Duration(*rule.MaxClockSkewSeconds) * time.Second
+			cr.MaxClockSkew = &d
 		}
-		if len(collections) == 0 {
-			if len(collectionsMap) == 0 {
-				collections = []string{"app.bsky.feed.post"}
+		if rule.MaxBackdateSeconds != nil {
+			d := time.Duration(*rule.MaxBackdateSeconds) * time.Second
+			cr.MaxBackdate = &d
+		}
+
+		// Post Age
+		if rule.MaxAgeSeconds != nil {
+			d := time.Duration(*rule.MaxAgeSeconds) * time.Second
+			cr.MaxAge = &d
+			cr.AllowUndated = config.UndatedPostPolicy == UndatedAllow
+		}
+
+		// Custom Matchers
+		if len(rule.CustomMatchers) > 0 {
+			fns, err := lookupMatchers(rule.CustomMatchers)
+			if err != nil {
+				return nil, fmt.Errorf("rule %q: invalid customMatchers: %w", cr.Name, err)
 			}
+			cr.CustomMatchers = fns
+			cr.CustomMatchAny = rule.CustomMatcherMode == CustomMatchAny
 		}
-		log.Printf("Subscribing to collections: %v", collections)
-	} else {
-		log.Printf("Subscribing to ALL collections (*)")
-		collections = nil // Firefly/Jetstream convention for "all"
+
+		// Profile Filters
+		if rule.MinFollowers != nil {
+			cr.MinFollowers = rule.MinFollowers
+		}
+		if rule.MinAccountAgeHours != nil {
+			d := time.Duration(*rule.MinAccountAgeHours) * time.Hour
+			cr.MinAccountAge = &d
+		}
+
+		cr.SampleRate = rule.SampleRate
+		cr.SampleConsistent = rule.SampleMode == SampleConsistent
+
+		// Weight
+		cr.Weight = 1
+		if rule.Weight != nil {
+			cr.Weight = *rule.Weight
+		}
+
+		// Author Cooldown
+		if rule.AuthorCooldownSeconds != nil && *rule.AuthorCooldownSeconds > 0 {
+			cr.Cooldown = NewAuthorCooldown(time.Duration(*rule.AuthorCooldownSeconds)*time.Second, maxCooldownAuthors)
+		}
+
+		cr.RedactText = rule.RedactText
+		cr.Tags = rule.Tags
+
+		// Output Template
+		if rule.OutputTemplate != "" {
+			tmpl, err := CompileOutputTemplate(cr.Name, rule.OutputTemplate)
+			if err != nil {
+				return nil, fmt.Errorf("rule %q: invalid output template: %w", cr.Name, err)
+			}
+			cr.OutputTemplate = tmpl
+		}
+
+		// Stale Warning Threshold
+		staleSeconds := config.RuleStaleWarningSeconds
+		if rule.StaleWarningSeconds != nil {
+			staleSeconds = *rule.StaleWarningSeconds
+		}
+		cr.StaleAfter = time.Duration(staleSeconds) * time.Second
+
+		return &cr, nil
 	}
 
-	// Determine Authors to subscribe to
-	var authors []string
-	if !subscribeToAllAuthors {
-		for a := range authorsMap {
-			authors = append(authors, a)
+	for i, rule := range config.Rules {
+		// Disabled rules are skipped entirely so they don't affect subscriptions or matching
+		if !rule.IsEnabled() {
+			slog.Info("Skipping disabled rule", "rule", ruleName(i, rule))
+			continue
+		}
+		cr, err := compileRule(i, rule)
+		if err != nil {
+			fatal("Invalid rule", "error", err)
+		}
+		if len(cr.SubjectTextPatterns) > 0 {
+			needSubjects = true
+		}
+		if cr.MinFollowers != nil || cr.MinAccountAge != nil {
+			needProfiles = true
+		}
+		if rule.Weight != nil {
+			scoring = true
+		}
+		compiledRules = append(compiledRules, *cr)
+	}
+	// Evaluation order, and so the order of matchedRules, is by priority, then config order
+	slices.SortStableFunc(compiledRules, func(a, b CompiledRuleSet) int {
+		return cmp.Compare(b.Priority, a.Priority)
+	})
+	slog.Info("Loaded rule sets", "count", len(compiledRules))
+	if scoring {
+		slog.Info("Scoring matches by rule weight", "minScore", config.MinScore)
+	}
+
+	if *checkFlag {
+		fmt.Printf("Config OK: %d rules\n", len(compiledRules))
+		fmt.Printf("Regex program size limit (maxRegexProgramSize): %d instructions\n", config.MaxRegexProgramSize)
+		for _, cr := range compiledRules {
+			if size, ok := largestRegex[cr.Name]; ok {
+				fmt.Printf("  %s: largest regex is %d instructions\n", cr.Name, size)
+			}
+		}
+		return
+	}
+
+	// Rules can be reloaded one at a time (see reloadRule), so handlers read them from a table
+	allRules := NewRuleTable(compiledRules)
+
+	ruleNames := make([]string, 0, len(compiledRules))
+	streamFilters := make(map[string]bool) // Names clients can pass in ?rules=
+	ruleGroups := make(map[string]string)  // Each grouped rule's group, for filtering stats frames
+	for _, cr := range compiledRules {
+		ruleNames = append(ruleNames, cr.Name)
+		streamFilters[cr.Name] = true
+		if cr.Group != "" {
+			streamFilters[cr.Group] = true
+			ruleGroups[cr.Name] = cr.Group
 		}
-		log.Printf("Subscribing to %d specific authors", len(authors))
-	} else {
-		log.Printf("Subscribing to ALL authors")
-		authors = nil
 	}
 
-	// Determine Cursor
-	var cursor *int64
-	if config.CursorOffset > 0 {
-		c := time.Now().UnixMicro() - config.CursorOffset
-		cursor = &c
-		log.Printf("Starting replay from %d microseconds ago (Cursor: %d)", config.CursorOffset, *cursor)
+	// Rules with their own cursorOffset get their own Jetstream connection
+	streams, err := partitionStreams(compiledRules, config.CursorOffset)
+	if err != nil {
+		fatal("Invalid cursorOffset", "error", err)
+	}
+	if len(streams) > 1 {
+		slog.Info("Opening one Jetstream connection per cursorOffset", "connections", len(streams))
 	}
 
 	// 3. Start the Hub
-	hub := NewHub()
+	hub := NewHub(HubOptions{
+		BatchWindow:  time.Duration(config.BroadcastBatchMillis) * time.Millisecond,
+		MaxClients:   config.MaxClients,
+		IdleTimeout:  time.Duration(config.ClientIdleTimeoutSeconds) * time.Second,
+		PingInterval: time.Duration(config.PingIntervalSeconds) * time.Second,
+		PongWait:     time.Duration(config.PongTimeoutSeconds) * time.Second,
+
+		MaxMessagesPerClient: config.MaxMessagesPerClient,
+		LegacyFrames:         config.LegacyFrames,
+	})
 	go hub.Run()
 
 	// 4. Setup Worker Pool
 	// We need a channel to buffer incoming posts from Firefly
-	jobQueue := make(chan *firefly.FirehoseEvent, 1000) // Buffer size 1000
+	jobQueue := make(chan Job, config.JobQueueSize)
+	slog.Info("Worker pool configured", "workers", config.Workers, "jobQueueSize", config.JobQueueSize, "broadcastBufferSize", config.BroadcastBufferSize, "queueFullPolicy", config.QueueFullPolicy)
 
 	// Start workers
-	go StartDispatcher(runtime.NumCPU(), jobQueue, hub.broadcast, compiledRules)
+	globalFilter := NewGlobalFilter(config.GlobalBlockDIDs, config.GlobalAllowDIDs, config.IgnoreCollections)
+	if len(config.GlobalBlockDIDs) > 0 || len(config.GlobalAllowDIDs) > 0 {
+		slog.Info("Global author filter enabled", "blocked", len(globalFilter.BlockedAuthors), "allowed", len(globalFilter.AllowedAuthors))
+	}
+	if len(config.IgnoreCollections) > 0 {
+		slog.Info("Ignoring collections", "collections", config.IgnoreCollections)
+	}
+	var resolver *HandleResolver
+	if config.ResolveHandles {
+		resolver = NewHandleResolver(config.PlcDirectory, time.Duration(config.HandleCacheTTLSeconds)*time.Second, config.HandleCacheSize, config.HandleResolverConcurrency)
+		slog.Info("Handle resolution enabled", "plcDirectory", config.PlcDirectory)
+	}
+	var profiles *ProfileCache
+	if needProfiles {
+		profiles = NewProfileCache(config.ProfileServer, time.Duration(config.ProfileCacheTTLSeconds)*time.Second, config.ProfileCacheSize, config.ProfileConcurrency, config.ProfileMissPolicy)
+		slog.Info("Profile enrichment enabled", "server", config.ProfileServer, "missPolicy", config.ProfileMissPolicy)
+	}
+	var subjects *SubjectCache
+	if needSubjects {
+		subjects = NewSubjectCache(config.ProfileServer, time.Duration(config.SubjectCacheTTLSeconds)*time.Second, config.SubjectCacheSize, config.SubjectConcurrency, normalizer)
+		slog.Info("Subject post enrichment enabled", "server", config.ProfileServer)
+	}
 
-	// 5. Start Firefly Consumer
-	go func() {
-		log.Println("Connecting to Bluesky...")
-		ctx := context.Background()
+	// Every match fans out to the websocket Hub and any configured sinks
+	output := NewSinkDispatcher()
+	var clients Sink = hub
+	if config.MaxBroadcastsPerSecond > 0 {
+		clients = NewRateLimitedSink(hub, config.MaxBroadcastsPerSecond)
+	}
+	output.Add("websocket", clients, config.BroadcastBufferSize)
+	replay := NewReplayBuffer(config.ReplayBufferSize)
+	if config.ReplayPersistPath != "" {
+		if err := replay.Load(config.ReplayPersistPath); err != nil {
+			slog.Error("Failed to load persisted replay buffer, starting empty", "path", config.ReplayPersistPath, "error", err)
+		} else {
+			slog.Info("Loaded persisted replay buffer", "path", config.ReplayPersistPath, "matches", replay.Len())
+		}
+	}
+	output.Add("replay", replay, config.BroadcastBufferSize)
 
-		// Create client
-		client, err := firefly.NewCustomInstance(ctx, config.BskyServer, new(http.Client))
+	// Sinks that can fail retry and dead-letter deliveries per their entry in sinks
+	deadLetters := make(map[string]*DeadLetterFile) // By path, so sinks can share a file
+	sinkPolicy := func(name string) SinkPolicy {
+		sc, ok := config.Sinks[name]
+		if !ok {
+			return SinkPolicy{}
+		}
+		backoff, _ := time.ParseDuration(sc.RetryBackoff) // Validated by LoadConfig
+		policy := SinkPolicy{MaxRetries: sc.MaxRetries, RetryBackoff: backoff}
+		if sc.DeadLetterFile != "" {
+			if deadLetters[sc.DeadLetterFile] == nil {
+				file, err := OpenDeadLetterFile(sc.DeadLetterFile)
+				if err != nil {
+					fatal("Failed to open dead-letter file", "sink", name, "path", sc.DeadLetterFile, "error", err)
+				}
+				deadLetters[sc.DeadLetterFile] = file
+			}
+			policy.DeadLetter = deadLetters[sc.DeadLetterFile]
+		}
+		slog.Info("Sink failure policy", "sink", name, "maxRetries", sc.MaxRetries, "retryBackoff", backoff, "deadLetterFile", sc.DeadLetterFile)
+		return policy
+	}
+
+	if config.SqlitePath != "" {
+		sqliteSink, err := NewSQLiteSink(config.SqlitePath, config.SqliteBatchSize, time.Duration(config.SqliteFlushMillis)*time.Millisecond, sinkPolicy("sqlite"))
 		if err != nil {
-			log.Printf("Error creating firefly client: %v", err)
-			return
+			fatal("Failed to open SQLite database", "path", config.SqlitePath, "error", err)
+		}
+		slog.Info("Storing matches in SQLite", "path", config.SqlitePath, "batchSize", config.SqliteBatchSize, "flushMillis", config.SqliteFlushMillis)
+		output.Add("sqlite", sqliteSink, config.SqliteBatchSize*2)
+	}
+	if config.Nats != nil && config.Nats.URL != "" {
+		natsSink, err := NewNATSSink(config.Nats.URL, config.Nats.SubjectPrefix)
+		if err != nil {
+			fatal("Failed to connect to NATS", "url", config.Nats.URL, "error", err)
 		}
+		slog.Info("Publishing matches to NATS", "url", config.Nats.URL, "subjectPrefix", config.Nats.SubjectPrefix)
+		output.AddFallible("nats", natsSink, config.Nats.BufferSize, sinkPolicy("nats"))
+	}
+
+	debugSampleRate := config.DebugSampleRate
+	if *debugFlag {
+		if debugSampleRate <= 0 {
+			debugSampleRate = 0.01
+		}
+		slog.Info("Debug mode enabled", "sampleRate", debugSampleRate)
+	}
+	workerOpts := WorkerOptions{
+		Filter:          globalFilter,
+		Resolver:        resolver,
+		Profiles:        profiles,
+		Subjects:        subjects,
+		Output:          output,
+		MatchDetails:    config.MatchDetails,
+		Scoring:         scoring,
+		MinScore:        config.MinScore,
+		DebugSampleRate: debugSampleRate,
+		Normalizer:      normalizer,
+		MaxTextBytes:    config.MaxTextBytes,
+		MaxListItems:    config.MaxListItems,
+		ReplayUntil:     time.Now().Add(time.Duration(config.StartupGraceSeconds) * time.Second),
+	}
+	// Workers exit once jobQueue is closed at shutdown and they've emptied it
+	workersDone := make(chan struct{})
+	go func() {
+		defer close(workersDone)
+		StartDispatcher(config.Workers, jobQueue, workerOpts)
+	}()
+	go WatchStaleRules(allRules, 30*time.Second)
+
+	// 5. Start Firefly Consumer
+	slog.Info("Connecting to Bluesky", "server", config.BskyServer)
+	// Cancelled on SIGINT or SIGTERM, which stops the consumer and shuts the servers down
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if config.MaxRuntimeSeconds > 0 {
+		// Running out of time takes the same shutdown path as a signal
+		maxRuntime := time.Duration(config.MaxRuntimeSeconds) * time.Second
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, maxRuntime)
+		defer cancel()
+		slog.Info("Scheduled shutdown", "maxRuntime", maxRuntime, "at", time.Now().Add(maxRuntime).Format(time.RFC3339))
+	}
 
-		// Determine Firehose URL
-		var jetstreamURL *string
-		log.Printf("StreamEvents starting...")
-		if config.JetstreamServer != "" {
-			jetstreamURL = &config.JetstreamServer
-			log.Printf("URL: %s\n", *jetstreamURL)
+	if config.ReplayPersistPath != "" {
+		go replay.PersistPeriodically(ctx, config.ReplayPersistPath)
+	}
+	if config.PushStatsIntervalSeconds > 0 {
+		if config.LegacyFrames {
+			slog.Warn("pushStatsIntervalSeconds needs typed frames, not pushing stats while legacyFrames is set")
 		} else {
-			log.Printf("URL: <default>")
+			go hub.PushStats(ctx, time.Duration(config.PushStatsIntervalSeconds)*time.Second, ruleGroups)
+		}
+	}
+
+	// The client is also used to parse events posted to /match/test
+	client, err := firefly.NewCustomInstance(ctx, config.BskyServer, new(http.Client))
+	if err != nil {
+		fatal("Error creating firefly client", "server", config.BskyServer, "error", err)
+	}
+
+	var savedCursors map[string]int64
+	if config.CursorPath != "" {
+		savedCursors, err = LoadCursors(config.CursorPath)
+		if err != nil {
+			slog.Error("Failed to load saved cursors, starting from cursorOffset", "path", config.CursorPath, "error", err)
 		}
+	}
 
-		events, err := client.StreamEvents(ctx, &firefly.FirehoseOptions{
-			Collections: collections,
-			Authors:     authors,
-			Cursor:      cursor,
-			BufferSize:  1000,
-			URL:         jetstreamURL,
+	for _, stream := range streams {
+		slog.Info("Configuring Jetstream connection", "stream", stream.name, "rules", len(stream.rules.Load()))
+		var cursor *int64
+		if saved, ok := savedCursors[stream.name]; ok && saved > 0 {
+			cursor = &saved
+			slog.Info("Resuming from saved cursor", "stream", stream.name, "cursor", saved)
+		} else if stream.cursorOffset > 0 {
+			c := time.Now().UnixMicro() - stream.cursorOffset
+			cursor = &c
+			slog.Info("Starting replay", "stream", stream.name, "offsetMicros", stream.cursorOffset, "cursor", *cursor)
+		}
+		collections := subscriptionCollections(stream.rules.Load(), config.IgnoreCollections)
+		if collections == nil {
+			slog.Info("Subscribing to ALL collections", "stream", stream.name)
+		} else {
+			slog.Info("Subscribing to collections", "stream", stream.name, "collections", collections)
+		}
+		stream.consumer, err = NewJetstreamConsumer(client, JetstreamOptions{
+			Servers:      servers,
+			Collections:  collections,
+			Authors:      subscriptionAuthors(stream.rules.Load()),
+			Cursor:       cursor,
+			Compress:     config.JetstreamCompress,
+			DropReplayed: config.DropReplayedBeforeCursor,
 		})
 		if err != nil {
-			log.Printf("Error starting firehose: %v", err)
-			return
+			fatal("Error creating Jetstream consumer", "error", err)
 		}
+	}
+
+	// Edits to list files apply to rules immediately; subscriptions follow any change in authors
+	err = didFiles.Watch(ctx, func() {
+		for _, stream := range streams {
+			stream.consumer.Resubscribe(subscriptionAuthors(stream.rules.Load()))
+		}
+	})
+	if err != nil {
+		slog.Error("Failed to watch DID list files, changes won't be picked up until restart", "error", err)
+	}
 
-		count := 0
-		lastLog := time.Now()
+	// Tracks the consumers, so shutdown knows when nothing more will be queued
+	var running sync.WaitGroup
+	for _, stream := range streams {
+		running.Add(1)
+		go func() {
+			defer running.Done()
+			slog.Info("Firehose starting", "stream", stream.name, "servers", stream.consumer.servers, "compress", config.JetstreamCompress)
 
-		for event := range events {
-			count++
-			if time.Since(lastLog) > 30*time.Second {
-				log.Printf("Heartbeat: Received %d events in last 30s", count)
-				count = 0
-				lastLog = time.Now()
+			count := 0
+			lastLog := time.Now()
+
+			stream.consumer.Run(ctx, func(event *firefly.FirehoseEvent, frame []byte) {
+				MarkEventReceived()
+				count++
+				if time.Since(lastLog) > 30*time.Second {
+					slog.Info("Heartbeat", "stream", stream.name, "events", count, "interval", time.Since(lastLog).Round(time.Second), "queueLen", len(jobQueue))
+					count = 0
+					lastLog = time.Now()
+				}
+
+				// We now pass ALL events to the worker, not just posts
+				// The worker will filter based on collection
+				job := Job{Event: event, Rules: stream.rules.Load(), Received: time.Now()}
+				if config.IncludeRawFrame {
+					job.RawFrame = frame
+				}
+				EnqueueEvent(jobQueue, job, config.QueueFullPolicy)
+			})
+		}()
+	}
+
+	// Check the firehose works before clients can connect to a feed that will stay empty
+	if config.RequireFirehoseOnStartup {
+		timeout := time.Duration(config.FirehoseStartupTimeoutSeconds) * time.Second
+		slog.Info("Waiting for the firehose before serving", "timeout", timeout)
+		waitCtx, cancel := context.WithTimeout(ctx, timeout)
+		for _, stream := range streams {
+			if err := stream.consumer.WaitForEvent(waitCtx); err != nil {
+				if ctx.Err() != nil {
+					cancel()
+					return // Interrupted while waiting
+				}
+				fatal("Firehose check failed", "stream", stream.name, "servers", stream.consumer.servers, "timeout", timeout, "error", err)
 			}
+		}
+		cancel()
+		slog.Info("Firehose check passed")
+	}
 
-			// We now pass ALL events to the worker, not just posts
-			// The worker will filter based on collection
-			jobQueue <- event
+	// reloadRule recompiles one running rule from the config files and swaps it into the rule
+	// tables. Anything decided once at startup can't change this way: the rule's stream,
+	// evaluation order, and the caches and subscriptions other rules share.
+	var reloadMu sync.Mutex
+	reloadRule := func(name string) (*CompiledRuleSet, error) {
+		reloadMu.Lock()
+		defer reloadMu.Unlock()
+
+		reloaded, err := LoadConfig(*configFlag)
+		if err != nil {
+			return nil, err
 		}
-	}()
+		// Rules are compiled against the settings they started with, so those must be unchanged
+		if changed := changedSettings(&loaded, reloaded); len(changed) > 0 {
+			return nil, fmt.Errorf("settings outside the rules changed (%s); restart to apply them", strings.Join(changed, ", "))
+		}
+		i := slices.IndexFunc(reloaded.Rules, func(rule RuleSet) bool { return rule.Name == name })
+		if i < 0 {
+			// Unnamed rules are known by position, which adding or removing a rule shifts
+			return nil, fmt.Errorf("rule %q is no longer in the config, or has no name; removing a rule needs a restart and only named rules can be reloaded", name)
+		}
+		rule := reloaded.Rules[i]
+		if !rule.IsEnabled() {
+			return nil, fmt.Errorf("rule %q is disabled in the config; disabling a rule needs a restart", name)
+		}
+
+		current := allRules.Load()
+		j := slices.IndexFunc(current, func(r CompiledRuleSet) bool { return r.Name == name })
+		if j < 0 {
+			return nil, fmt.Errorf("rule %q wasn't running at startup; adding or enabling a rule needs a restart", name)
+		}
+		old := current[j]
+		cr, err := compileRule(i, rule)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case cr.Group != old.Group:
+			return nil, fmt.Errorf("rule %q: changing group needs a restart", name)
+		case cr.Priority != old.Priority || cr.StopOnMatch != old.StopOnMatch:
+			return nil, fmt.Errorf("rule %q: changing priority or stopOnFirstMatch needs a restart", name)
+		case !equalOffsets(cr.CursorOffset, old.CursorOffset):
+			return nil, fmt.Errorf("rule %q: changing cursorOffset or cursorLookback needs a restart", name)
+		case (cr.MinFollowers != nil || cr.MinAccountAge != nil) && profiles == nil:
+			return nil, fmt.Errorf("rule %q: minFollowers and minAccountAgeHours need a restart when no rule used them at startup", name)
+		case len(cr.SubjectTextPatterns) > 0 && subjects == nil:
+			return nil, fmt.Errorf("rule %q: subjectTextRegexes need a restart when no rule used them at startup", name)
+		case rule.Weight != nil && !scoring:
+			return nil, fmt.Errorf("rule %q: weight needs a restart when scoring was off at startup", name)
+		}
+
+		for _, stream := range streams {
+			rules := withRule(stream.rules.Load(), *cr)
+			if rules == nil {
+				continue
+			}
+			// Jetstream only takes a collection filter when connecting
+			if !slices.Equal(subscriptionCollections(rules, config.IgnoreCollections), subscriptionCollections(stream.rules.Load(), config.IgnoreCollections)) {
+				return nil, fmt.Errorf("rule %q: changing the collections subscribed to needs a restart", name)
+			}
+			stream.rules.Store(rules)
+			stream.consumer.Resubscribe(subscriptionAuthors(rules))
+		}
+		allRules.Store(withRule(allRules.Load(), *cr))
+		slog.Info("Reloaded rule", "rule", name)
+		return cr, nil
+	}
 
 	// 6. Start HTTP Server
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+	// Routes go on their own mux rather than http.DefaultServeMux, which importing net/http/pprof
+	// would quietly add the profiling handlers to
+	mux := http.NewServeMux()
+
+	// Operational endpoints move to their own server when adminPort is set
+	adminMux := mux
+	if config.AdminPort != 0 {
+		adminMux = http.NewServeMux()
+	}
+
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		http.ServeFile(w, r, "client.html")
 	})
 
-	http.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
-		serveWs(hub, w, r)
-	})
+	wsHandler := func(w http.ResponseWriter, r *http.Request) {
+		serveWs(hub, streamFilters, w, r)
+	}
+	sseHandler := func(w http.ResponseWriter, r *http.Request) {
+		serveSSE(hub, streamFilters, w, r)
+	}
+	mux.HandleFunc("/ws", requireStreamToken(config.WsAuthToken, wsHandler))
+	mux.HandleFunc("/sse", requireStreamToken(config.WsAuthToken, sseHandler))
+
+	// Single-feed streams, e.g. /ws/Tech%20News, for embedding one feed without a ?rules= filter
+	mux.HandleFunc("/ws/{rule}", requireStreamToken(config.WsAuthToken, requireKnownRule(streamFilters, wsHandler)))
+	mux.HandleFunc("/sse/{rule}", requireStreamToken(config.WsAuthToken, requireKnownRule(streamFilters, sseHandler)))
+
+	mux.HandleFunc("/recent", requireStreamToken(config.WsAuthToken, gzipJSON(recentHandler(replay, streamFilters))))
 
-	http.HandleFunc("/rules", func(w http.ResponseWriter, r *http.Request) {
+	mux.HandleFunc("/rules", gzipJSON(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(ruleNames)
-	})
+		// ?format=names returns the legacy flat list of rule names
+		if r.URL.Query().Get("format") == "names" {
+			json.NewEncoder(w).Encode(ruleNames)
+			return
+		}
+		rules := allRules.Load()
+		ruleInfos := make([]RuleInfo, 0, len(rules))
+		for _, cr := range rules {
+			ruleInfos = append(ruleInfos, cr.Info())
+		}
+		json.NewEncoder(w).Encode(ruleInfos)
+	}))
 
-	http.HandleFunc("/config", func(w http.ResponseWriter, r *http.Request) {
+	mux.HandleFunc("/config", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(PublicConfig{
-			BskyServer: config.BskyServer,
+			BskyServer:           config.BskyServer,
+			BroadcastBatchMillis: config.BroadcastBatchMillis,
+			SchemaVersion:        SchemaVersion,
+			LegacyFrames:         config.LegacyFrames,
 		})
 	})
 
-	http.HandleFunc("/stats", func(w http.ResponseWriter, r *http.Request) {
+	adminMux.HandleFunc("/stats", gzipJSON(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(GlobalRuleStats.GetCounts())
+		snapshot := GlobalRuleStats.Snapshot()
+		snapshot.SinkQueues = output.QueueStats()
+		json.NewEncoder(w).Encode(snapshot)
+	}))
+
+	// Only the author count is exposed, so this needs no admin token
+	adminMux.HandleFunc("/subscription", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(streamSubscriptions(streams))
 	})
 
-	addr := fmt.Sprintf(":%d", config.Port)
-	log.Printf("Server starting on %s", addr)
-	err = http.ListenAndServe(addr, nil)
-	if err != nil {
-		log.Fatal("ListenAndServe: ", err)
+	adminMux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		staleness := time.Duration(config.HealthStalenessSeconds) * time.Second
+		healthy, reason := CheckHealth(staleness, len(jobQueue), cap(jobQueue))
+		if !healthy {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			json.NewEncoder(w).Encode(HealthStatus{Status: "unhealthy", Reason: reason})
+			return
+		}
+		json.NewEncoder(w).Encode(HealthStatus{Status: "ok"})
+	})
+
+	adminMux.HandleFunc("/match/test", requireAdminToken(config.AdminToken, matchTestHandler(client, allRules, globalFilter, profiles, subjects, normalizer)))
+	adminMux.HandleFunc("/rules/{rule}/reload", requireAdminToken(config.AdminToken, reloadRuleHandler(ruleNames, reloadRule)))
+	adminMux.HandleFunc("/test/broadcast", requireAdminToken(config.AdminToken, testBroadcastHandler(hub)))
+
+	if config.EnablePprof {
+		adminMux.HandleFunc("/debug/pprof/", pprof.Index)
+		adminMux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		adminMux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		adminMux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		adminMux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+		slog.Warn("pprof enabled at /debug/pprof/, don't expose this port publicly")
+	}
+
+	httpServers := []*http.Server{{Addr: config.ListenAddr(config.Port), Handler: mux}}
+	if adminMux != mux {
+		httpServers = append(httpServers, &http.Server{Addr: config.ListenAddr(config.AdminPort), Handler: adminMux})
+	}
+	for i, srv := range httpServers {
+		go func() {
+			slog.Info("Server starting", "addr", srv.Addr, "admin", i > 0)
+			if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				fatal("ListenAndServe failed", "addr", srv.Addr, "error", err)
+			}
+		}()
+	}
+
+	<-ctx.Done()
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		slog.Info("Shutting down, maxRuntimeSeconds reached")
+	} else {
+		slog.Info("Shutting down")
 	}
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	// Match everything the firehose already delivered, so the saved cursor covers it
+	drained := make(chan struct{})
+	go func() {
+		running.Wait()
+		close(jobQueue)
+		<-workersDone
+		close(drained)
+	}()
+	processed := true
+	select {
+	case <-drained:
+	case <-shutdownCtx.Done():
+		processed = false
+		slog.Warn("Timed out matching queued events", "queueLen", len(jobQueue))
+	}
+
+	// Deliver queued matches to every sink, including the Hub, then say goodbye to clients
+	if err := output.Close(shutdownCtx); err != nil {
+		slog.Warn("Sinks did not finish delivering queued matches", "error", err)
+	} else {
+		for path, file := range deadLetters {
+			if err := file.Close(); err != nil {
+				slog.Error("Failed to close dead-letter file", "path", path, "error", err)
+			}
+		}
+	}
+	if err := hub.Close(shutdownCtx); err != nil {
+		slog.Warn("Not every client was disconnected cleanly", "error", err)
+	}
+	for _, srv := range httpServers {
+		if err := srv.Shutdown(shutdownCtx); err != nil {
+			slog.Warn("Server did not shut down cleanly", "addr", srv.Addr, "error", err)
+		}
+	}
+
+	if config.ReplayPersistPath != "" {
+		if err := replay.Save(config.ReplayPersistPath); err != nil {
+			slog.Error("Failed to persist replay buffer", "path", config.ReplayPersistPath, "error", err)
+		}
+	}
+	if config.CursorPath != "" {
+		if !processed {
+			// Resuming past unmatched events would skip them, so keep the previous cursors
+			slog.Warn("Not saving cursors, some received events weren't matched", "path", config.CursorPath)
+		} else if err := SaveCursors(config.CursorPath, streams); err != nil {
+			slog.Error("Failed to save cursors", "path", config.CursorPath, "error", err)
+		} else {
+			slog.Info("Saved cursors", "path", config.CursorPath)
+		}
+	}
+	slog.Info("Shutdown complete")
 }
 
-func serveWs(hub *Hub, w http.ResponseWriter, r *http.Request) {
+// requireKnownRule answers 404 for a /ws/{rule} or /sse/{rule} path that names no rule or group.
+// Names are compared exactly after the path is unescaped, so only configured names get through.
+func requireKnownRule(known map[string]bool, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !known[r.PathValue("rule")] {
+			http.Error(w, "unknown rule or group", http.StatusNotFound)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// ruleFilter parses a comma-separated ?rules= list of rule or group names, or takes the single
+// name from a /ws/{rule} path. It returns nil, meaning every match, when neither is given.
+func ruleFilter(r *http.Request, known map[string]bool) (map[string]bool, error) {
+	param := r.URL.Query().Get("rules")
+	if name := r.PathValue("rule"); name != "" {
+		if param != "" {
+			return nil, fmt.Errorf("?rules= can't be combined with a rule in the path")
+		}
+		return map[string]bool{name: true}, nil
+	}
+	if param == "" {
+		return nil, nil
+	}
+	filter := make(map[string]bool)
+	for _, name := range strings.Split(param, ",") {
+		name = strings.TrimSpace(name)
+		if !known[name] {
+			return nil, fmt.Errorf("unknown rule or group %q", name)
+		}
+		filter[name] = true
+	}
+	return filter, nil
+}
+
+// subscriptionCollections returns the collections to subscribe to for rules, or nil to subscribe
+// to all collections because some rule uses a glob or there are more than Jetstream filters on
+func subscriptionCollections(rules []CompiledRuleSet, ignore []string) []string {
+	seen := make(map[string]bool)
+	var collections []string
+	for _, rule := range rules {
+		for _, c := range rule.Collections {
+			if IsCollectionGlob(c) {
+				return nil // Jetstream convention for "all"
+			}
+			// Exclude pseudo-collections used for internal filtering, and collections that would only be dropped
+			if c == "identity" || c == "account" || slices.Contains(ignore, c) || seen[c] {
+				continue
+			}
+			seen[c] = true
+			collections = append(collections, c)
+		}
+	}
+	if len(collections) == 0 {
+		// Jetstream sends identity and account events regardless of wantedCollections,
+		// so rules that only want those still need a narrow subscription rather than everything
+		collections = []string{"app.bsky.feed.post"}
+	}
+	if len(collections) > maxWantedCollections {
+		// Jetstream would ignore the rest, so filter locally instead
+		return nil
+	}
+	return collections
+}
+
+// subscriptionAuthors returns the DIDs to subscribe to, or nil to subscribe to all authors
+// because some rule isn't limited to specific authors
+func subscriptionAuthors(rules []CompiledRuleSet) []string {
+	if len(rules) == 0 {
+		slog.Info("Subscribing to ALL authors")
+		return nil
+	}
+	authorsMap := make(map[string]bool)
+	for _, rule := range rules {
+		if len(rule.Authors) == 0 {
+			slog.Info("Subscribing to ALL authors")
+			return nil
+		}
+		for _, set := range rule.Authors {
+			for author := range set.All() {
+				authorsMap[author] = true
+			}
+		}
+	}
+	if len(authorsMap) > maxWantedDids {
+		// Jetstream can't filter on this many DIDs, so take everything and let the rules filter
+		slog.Info("Too many authors for a filtered subscription, filtering locally", "count", len(authorsMap), "max", maxWantedDids)
+		return nil
+	}
+	authors := make([]string, 0, len(authorsMap))
+	for author := range authorsMap {
+		authors = append(authors, author)
+	}
+	slog.Info("Subscribing to specific authors", "count", len(authors))
+	return authors
+}
+
+func serveWs(hub *Hub, known map[string]bool, w http.ResponseWriter, r *http.Request) {
+	rules, err := ruleFilter(r, known)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Reject before upgrading so a full server costs almost nothing per attempt
+	if !hub.AcquireSlot() {
+		w.Header().Set("Retry-After", "30")
+		http.Error(w, "too many websocket clients", http.StatusServiceUnavailable)
+		slog.Warn("Rejected websocket client, at capacity", "clients", hub.ClientCount())
+		return
+	}
+
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
-		log.Println(err)
+		hub.ReleaseSlot()
+		slog.Warn("Websocket upgrade failed", "error", err)
 		return
 	}
-	hub.register <- conn
+	// ?batch=1 opts into array frames when the server has batching enabled
+	client := &hubClient{
+		conn:    conn,
+		batched: r.URL.Query().Get("batch") == "1",
+		rules:   rules,
+		send:    make(chan []byte, clientSendBuffer),
+	}
+	hub.register <- client
+
+	hub.keepAlive(conn)
 
 	// Start a read loop to handle control messages (Close, Ping, etc.)
 	// This ensures the connection is properly maintained and closed.
 	go func() {
 		defer func() {
-			hub.unregister <- conn
+			hub.unregister <- client
 			conn.Close()
 		}()
 		for {
 			_, _, err := conn.ReadMessage()
 			if err != nil {
-				if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure, websocket.CloseNoStatusReceived) {
-					log.Printf("websocket error: %v", err)
+				if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+					slog.Debug("Websocket client idle, disconnecting", "remote", conn.RemoteAddr().String())
+				} else if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure, websocket.CloseNoStatusReceived, CloseQuotaExceeded) {
+					slog.Warn("Websocket error", "error", err)
 				}
 				break
 			}
+			hub.touch(conn)
 		}
 	}()
 }
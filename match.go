@@ -0,0 +1,1213 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"regexp/syntax"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/TheAlyxGreen/firefly"
+	"github.com/bluesky-social/indigo/api/bsky"
+)
+
+// Rule evaluation stages, reported when a rule fails to match
+const (
+	StageCollection       = "collection"
+	StageOperation        = "operation"
+	StageAuthor           = "author"
+	StageTargetUser       = "targetUser"
+	StageTargetInvolved   = "targetInvolved"
+	StageQuoteTarget      = "quoteTarget"
+	StageTargetCollection = "targetCollection"
+	StageAccountStatus    = "accountStatus"
+	StageIdentity         = "identity"
+	StageFollowers        = "followers"
+	StageAccountAge       = "accountAge"
+	StageText             = "text"
+	StageUrl              = "url"
+	StageExternalTitle    = "externalTitle"
+	StageExternalDesc     = "externalDesc"
+	StageEmbed            = "embed"
+	StageFacets           = "facets"
+	StageVideo            = "video"
+	StageAltText          = "altText"
+	StageLang             = "lang"
+	StageIsReply          = "isReply"
+	StageReplyDepth       = "replyDepth"
+	StageSelfReply        = "selfReply"
+	StageThreadgate       = "threadgate"
+	StageTimeWindow       = "timeWindow"
+	StageClockSkew        = "clockSkew"
+	StageMaxAge           = "maxAge"
+	StageSubjectText      = "subjectText"
+	StageCustomMatcher    = "customMatcher"
+	StageGroup            = "group"   // Skipped because another rule in its group already failed
+	StageStopped          = "stopped" // Skipped because an earlier rule with stopOnFirstMatch matched
+)
+
+// EventInfo holds the per-event values rules are matched against, computed once per event
+type EventInfo struct {
+	Event         *firefly.FirehoseEvent
+	Collection    string
+	AuthorDID     string
+	TargetUserDID string
+
+	// Operation is the commit operation (create, update, delete); empty for identity and account events
+	Operation string
+
+	// AccountStatus is the account's status for account events ("active", "deactivated", "takendown", ...)
+	AccountStatus string
+
+	// Profiles looks up author profiles for rules that need them; nil when no rule does
+	Profiles *ProfileCache
+
+	// Subjects looks up the text of reposted and quoted posts for rules that need it; nil when no rule does
+	Subjects *SubjectCache
+
+	// TargetCollection is the collection of the record a like or repost points at; empty for other events
+	TargetCollection string
+
+	// Text is the post text rules match against, after any textNormalization; empty for other events
+	Text string
+
+	// Threadgate is the parsed record of threadgate creates and updates; nil for other events
+	Threadgate *Threadgate
+
+	profile        *Profile // Memoized by AuthorProfile
+	profileChecked bool
+}
+
+// RuleResult is the outcome of evaluating one rule against one event
+type RuleResult struct {
+	Matched     bool
+	FailedStage string // The first check that failed, empty when matched
+	Backdated   bool   // The post exceeded the rule's MaxBackdate
+
+	Details *MatchDetail // Which conditions triggered the match, when requested
+
+	// Captures holds the named groups of the text pattern that matched, for captureGroups rules
+	Captures map[string]string
+}
+
+// MatchDetail records which of a rule's conditions triggered a match, so clients can
+// highlight the matching keyword. Only conditions the rule actually has are filled in.
+type MatchDetail struct {
+	TextPattern *int   `json:"textPattern,omitempty"` // Index into the rule's textRegexes
+	TextMatch   string `json:"textMatch,omitempty"`   // The text the pattern matched
+	UrlPattern  *int   `json:"urlPattern,omitempty"`  // Index into the rule's urlRegexes
+
+	ExternalTitlePattern *int   `json:"externalTitlePattern,omitempty"` // Index into the rule's externalTitleRegexes
+	ExternalDescPattern  *int   `json:"externalDescPattern,omitempty"`  // Index into the rule's externalDescRegexes
+	SubjectTextPattern   *int   `json:"subjectTextPattern,omitempty"`   // Index into the rule's subjectTextRegexes
+	AltTextPattern       *int   `json:"altTextPattern,omitempty"`       // Index into the rule's altTextRegexes
+	EmbedType            string `json:"embedType,omitempty"`            // The embed type that matched
+}
+
+// DescribeEvent determines the collection, author, and target user of an event
+func DescribeEvent(event *firefly.FirehoseEvent) *EventInfo {
+	info := &EventInfo{Event: event}
+
+	// 1. Determine Author
+	info.AuthorDID = event.Repo
+
+	// 2. Determine Collection
+	switch event.Type {
+	case firefly.EventTypePost:
+		info.Collection = "app.bsky.feed.post"
+	case firefly.EventTypeLike:
+		info.Collection = "app.bsky.feed.like"
+	case firefly.EventTypeRepost:
+		info.Collection = "app.bsky.feed.repost"
+	case firefly.EventTypeFollow:
+		info.Collection = "app.bsky.graph.follow"
+	case firefly.EventTypeDelete:
+		if event.DeleteEvent != nil {
+			info.Collection = event.DeleteEvent.Collection
+		}
+	case firefly.EventTypeIdentity:
+		info.Collection = "identity"
+	case firefly.EventTypeAccount:
+		info.Collection = "account"
+	default:
+		// Collections firefly doesn't parse still carry their NSID on the raw commit
+		if event.RawCommit != nil && event.RawCommit.Commit != nil {
+			info.Collection = event.RawCommit.Commit.Collection
+		}
+	}
+
+	if event.RawCommit != nil && event.RawCommit.Commit != nil {
+		info.Operation = event.RawCommit.Commit.Operation
+	}
+	if event.Post != nil {
+		info.Text = event.Post.Text
+	}
+	if info.Collection == ThreadgateCollection && event.RawCommit != nil && event.RawCommit.Commit != nil {
+		info.Threadgate = parseThreadgate(event.RawCommit.Commit.Record)
+	}
+
+	if event.AccountEvent != nil {
+		info.AccountStatus = event.AccountEvent.Status
+		if info.AccountStatus == "" && event.AccountEvent.Active {
+			// Jetstream only sends a status for inactive accounts
+			info.AccountStatus = "active"
+		}
+	}
+
+	// 3. Determine Target User
+	if event.LikeEvent != nil && event.LikeEvent.Subject != nil {
+		info.TargetUserDID = uriDID(event.LikeEvent.Subject.URI)
+		info.TargetCollection = atURICollection(event.LikeEvent.Subject.URI)
+	} else if event.RepostEvent != nil && event.RepostEvent.Subject != nil {
+		info.TargetUserDID = uriDID(event.RepostEvent.Subject.URI)
+		info.TargetCollection = atURICollection(event.RepostEvent.Subject.URI)
+	} else if event.Post != nil && event.Post.ReplyInfo != nil && event.Post.ReplyInfo.ReplyTarget != nil {
+		info.TargetUserDID = uriDID(event.Post.ReplyInfo.ReplyTarget.URI)
+	} else if event.Type == firefly.EventTypeFollow && event.User != nil {
+		// The follow record's subject is the followed account. Unfollows arrive as deletes,
+		// which carry no record, so they never have a target.
+		info.TargetUserDID = event.User.Did
+	}
+
+	return info
+}
+
+// uriDID returns the DID an AT-URI belongs to, or "" if it can't be parsed
+func uriDID(uri string) string {
+	did, err := firefly.ExtractDidFromUri(uri)
+	if err != nil && err != firefly.ErrNoDid {
+		return ""
+	}
+	return did
+}
+
+// InvolvedDIDs returns every account the event is aimed at: the target user (the reply parent's
+// author, the liked or reposted record's author, or the followed account), mentioned accounts,
+// and the quoted post's author. It may contain duplicates.
+func (info *EventInfo) InvolvedDIDs() []string {
+	var dids []string
+	if info.TargetUserDID != "" {
+		dids = append(dids, info.TargetUserDID)
+	}
+	post := info.Event.Post
+	if post == nil {
+		return dids
+	}
+	for _, facet := range post.Facets {
+		if facet.Type == firefly.MentionFacet && facet.Target != "" {
+			dids = append(dids, facet.Target)
+		}
+	}
+	if post.Embed != nil && post.Embed.Record != nil {
+		if did := uriDID(post.Embed.Record.URI); did != "" {
+			dids = append(dids, did)
+		}
+	}
+	return dids
+}
+
+// SubjectPostURI returns the AT-URI of the post a repost or quote points at, or "" if the
+// event is neither or points at something other than a post
+func (info *EventInfo) SubjectPostURI() string {
+	event := info.Event
+	var uri string
+	if event.RepostEvent != nil && event.RepostEvent.Subject != nil {
+		uri = event.RepostEvent.Subject.URI
+	} else if event.Post != nil && event.Post.Embed != nil && event.Post.Embed.Record != nil {
+		uri = event.Post.Embed.Record.URI
+	}
+	if atURICollection(uri) != "app.bsky.feed.post" {
+		return ""
+	}
+	return uri
+}
+
+// QuotedPostURI returns the AT-URI of the post a quote post embeds, with or without media. It
+// is empty for other events and for posts embedding other records, like feeds or lists.
+func (info *EventInfo) QuotedPostURI() string {
+	post := info.Event.Post
+	if post == nil || post.Embed == nil || post.Embed.Record == nil {
+		return ""
+	}
+	if atURICollection(post.Embed.Record.URI) != "app.bsky.feed.post" {
+		return ""
+	}
+	return post.Embed.Record.URI
+}
+
+// atURICollection returns the collection segment of an AT-URI (at://<did>/<collection>/<rkey>)
+func atURICollection(uri string) string {
+	parts := strings.SplitN(strings.TrimPrefix(uri, "at://"), "/", 3)
+	if len(parts) < 2 {
+		return ""
+	}
+	return parts[1]
+}
+
+// RuleMatch is a rule that matched an event, with its result
+type RuleMatch struct {
+	Rule   *CompiledRuleSet
+	Result RuleResult
+}
+
+// MatchRules evaluates every rule against an event. Ungrouped rules match on their own, while
+// rules sharing a Group only match if every rule in the group does; once one member fails, the
+// rest of its group is skipped. Rules are evaluated in order, which is by priority, and a match
+// of a rule with StopOnMatch skips the rules after it. It returns the matching rules, in
+// evaluation order, and the groups that matched. report, if non-nil, is called with each
+// rule's own result.
+func MatchRules(rules []CompiledRuleSet, info *EventInfo, details bool, report func(*CompiledRuleSet, RuleResult)) ([]RuleMatch, []string) {
+	var matches []RuleMatch
+	var failedGroups map[string]bool
+
+	for i := range rules {
+		rule := &rules[i]
+		if rule.Group != "" && failedGroups[rule.Group] {
+			if report != nil {
+				report(rule, RuleResult{FailedStage: StageGroup})
+			}
+			continue
+		}
+		result := rule.Evaluate(info, details)
+		if report != nil {
+			report(rule, result)
+		}
+		if !result.Matched {
+			if rule.Group != "" {
+				if failedGroups == nil {
+					failedGroups = make(map[string]bool)
+				}
+				failedGroups[rule.Group] = true
+			}
+			continue
+		}
+		matches = append(matches, RuleMatch{Rule: rule, Result: result})
+		if rule.StopOnMatch {
+			if report != nil {
+				for j := i + 1; j < len(rules); j++ {
+					report(&rules[j], RuleResult{FailedStage: StageStopped})
+				}
+			}
+			break
+		}
+	}
+
+	// Members matched before a later member of their group failed are dropped here
+	var groups []string
+	kept := matches[:0]
+	for _, m := range matches {
+		if group := m.Rule.Group; group != "" {
+			if failedGroups[group] {
+				continue
+			}
+			if !slices.Contains(groups, group) {
+				groups = append(groups, group)
+			}
+		}
+		kept = append(kept, m)
+	}
+	return kept, groups
+}
+
+// externalLink returns a post's link card, or nil if it doesn't have one
+func externalLink(event *firefly.FirehoseEvent) *firefly.EmbedLink {
+	if event.Post == nil || event.Post.Embed == nil {
+		return nil
+	}
+	return event.Post.Embed.External
+}
+
+// videoEmbed returns a post's video embed, including one alongside a quoted record, or nil
+func videoEmbed(event *firefly.FirehoseEvent) *bsky.EmbedVideo {
+	if event.Post == nil || event.Post.Embed == nil || event.Post.Embed.Raw == nil {
+		return nil
+	}
+	raw := event.Post.Embed.Raw
+	if raw.EmbedVideo != nil {
+		return raw.EmbedVideo
+	}
+	if raw.EmbedRecordWithMedia != nil && raw.EmbedRecordWithMedia.Media != nil {
+		return raw.EmbedRecordWithMedia.Media.EmbedVideo
+	}
+	return nil
+}
+
+// imageAltTexts returns the alt text of each of a post's images, including images alongside a
+// quoted record, or nil if it has none. Images without alt text contribute an empty string.
+func imageAltTexts(event *firefly.FirehoseEvent) []string {
+	if event.Post == nil || event.Post.Embed == nil || event.Post.Embed.Raw == nil {
+		return nil
+	}
+	raw := event.Post.Embed.Raw
+	images := raw.EmbedImages
+	if images == nil && raw.EmbedRecordWithMedia != nil && raw.EmbedRecordWithMedia.Media != nil {
+		images = raw.EmbedRecordWithMedia.Media.EmbedImages
+	}
+	if images == nil || len(images.Images) == 0 {
+		return nil
+	}
+	alts := make([]string, 0, len(images.Images))
+	for _, img := range images.Images {
+		if img == nil {
+			continue
+		}
+		alts = append(alts, strings.TrimSpace(img.Alt))
+	}
+	return alts
+}
+
+// Alt text conditions for altTextSource rules
+const (
+	AltTextAny     = "any"     // Any post with images
+	AltTextPresent = "present" // Every image has alt text
+	AltTextAbsent  = "absent"  // At least one image has none
+)
+
+// altTextAllows reports whether a post's image alt texts satisfy an altTextSource condition
+func altTextAllows(source string, alts []string) bool {
+	missing := slices.Contains(alts, "")
+	switch source {
+	case AltTextPresent:
+		return !missing
+	case AltTextAbsent:
+		return missing
+	}
+	return true
+}
+
+// Video aspects for videoAspect rules
+const (
+	VideoPortrait  = "portrait"
+	VideoLandscape = "landscape"
+	VideoSquare    = "square"
+)
+
+// videoAspect classifies a video by its declared aspect ratio, or returns "" if it has none
+func videoAspect(video *bsky.EmbedVideo) string {
+	ratio := video.AspectRatio
+	if ratio == nil || ratio.Width <= 0 || ratio.Height <= 0 {
+		return ""
+	}
+	switch {
+	case ratio.Height > ratio.Width:
+		return VideoPortrait
+	case ratio.Width > ratio.Height:
+		return VideoLandscape
+	default:
+		return VideoSquare
+	}
+}
+
+// videoDurationOnce limits the note that maxVideoSeconds can't be applied to one log line
+var videoDurationOnce sync.Once
+
+// matchAny returns the index of the first pattern matching s, or -1 if none do
+func matchAny(patterns []*regexp.Regexp, s string) int {
+	for i, pattern := range patterns {
+		if pattern.MatchString(s) {
+			return i
+		}
+	}
+	return -1
+}
+
+// namedCaptures returns the named groups of a match by their names, given the submatch
+// indexes from FindStringSubmatchIndex. Groups that didn't take part in the match are left
+// out, and it returns nil if none did.
+func namedCaptures(pattern *regexp.Regexp, s string, loc []int) map[string]string {
+	var captures map[string]string
+	for i, name := range pattern.SubexpNames() {
+		if name == "" || loc[2*i] < 0 {
+			continue
+		}
+		if captures == nil {
+			captures = make(map[string]string)
+		}
+		captures[name] = s[loc[2*i]:loc[2*i+1]]
+	}
+	return captures
+}
+
+// hasNamedGroups reports whether a pattern has any named capture groups
+func hasNamedGroups(pattern *regexp.Regexp) bool {
+	for _, name := range pattern.SubexpNames() {
+		if name != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// Evaluate runs the rule's checks against an event in order, stopping at the first failure.
+// With details set, a match also records which pattern or embed type triggered it, which
+// costs an extra pass over the text patterns. Rules with CaptureGroups take that pass too.
+func (rule *CompiledRuleSet) Evaluate(info *EventInfo, details bool) RuleResult {
+	event := info.Event
+	fail := func(stage string) RuleResult {
+		return RuleResult{FailedStage: stage}
+	}
+	var detail *MatchDetail
+	if details {
+		detail = &MatchDetail{}
+	}
+	var captures map[string]string
+
+	// 1. Check Collection (supports "*" and trailing-glob patterns)
+	if len(rule.Collections) > 0 {
+		collectionMatch := false
+		for _, c := range rule.Collections {
+			if MatchCollection(c, info.Collection) {
+				collectionMatch = true
+				break
+			}
+		}
+		if !collectionMatch {
+			return fail(StageCollection)
+		}
+	}
+
+	// 2. Check Operation (events without one, like identity and account, bypass it)
+	if len(rule.Operations) > 0 && info.Operation != "" {
+		operationMatch := false
+		for _, op := range rule.Operations {
+			if op == info.Operation {
+				operationMatch = true
+				break
+			}
+		}
+		if !operationMatch {
+			return fail(StageOperation)
+		}
+	}
+
+	// 3. Check Author (Exact Match)
+	if len(rule.Authors) > 0 {
+		if !rule.Authors.Contains(info.AuthorDID) {
+			return fail(StageAuthor)
+		}
+	}
+
+	// Identity rules only match identity events, which have none of the remaining
+	// interaction or post properties, so those checks are skipped entirely
+	if rule.IdentityChanges {
+		if event.IdentityEvent == nil {
+			return fail(StageIdentity)
+		}
+		return RuleResult{Matched: true, Details: detail}
+	}
+
+	// 4. Check Target User (Exact Match)
+	if len(rule.TargetUsers) > 0 {
+		if info.TargetUserDID == "" || !rule.TargetUsers.Contains(info.TargetUserDID) {
+			return fail(StageTargetUser)
+		}
+	}
+
+	// 5. Check Target Involved (reply parent, mention, like/repost subject, or quote subject)
+	if len(rule.TargetInvolved) > 0 {
+		if !slices.ContainsFunc(info.InvolvedDIDs(), rule.TargetInvolved.Contains) {
+			return fail(StageTargetInvolved)
+		}
+	}
+
+	// 6. Check Quote Targets (quote posts only, including quotes with media)
+	if len(rule.QuoteTargets) > 0 {
+		did := uriDID(info.QuotedPostURI())
+		if did == "" || !rule.QuoteTargets.Contains(did) {
+			return fail(StageQuoteTarget)
+		}
+	}
+
+	// 7. Check Target Collection (likes and reposts only)
+	if len(rule.TargetCollections) > 0 {
+		if info.TargetCollection == "" {
+			return fail(StageTargetCollection)
+		}
+		targetMatch := false
+		for _, c := range rule.TargetCollections {
+			if MatchCollection(c, info.TargetCollection) {
+				targetMatch = true
+				break
+			}
+		}
+		if !targetMatch {
+			return fail(StageTargetCollection)
+		}
+	}
+
+	// 8. Check Account Status (account events only)
+	if len(rule.AccountStatuses) > 0 {
+		if info.AccountStatus == "" {
+			return fail(StageAccountStatus)
+		}
+		statusMatch := false
+		for _, status := range rule.AccountStatuses {
+			if status == info.AccountStatus {
+				statusMatch = true
+				break
+			}
+		}
+		if !statusMatch {
+			return fail(StageAccountStatus)
+		}
+	}
+
+	// 9. Check Text Patterns (if any)
+	if len(rule.TextPatterns) > 0 {
+		if event.Post == nil {
+			return fail(StageText)
+		}
+
+		textConditionMet := false
+		if rule.CombinedText != nil && !details && !rule.CaptureGroups {
+			textConditionMet = rule.textPrefilterPasses(info.Text) && rule.CombinedText.MatchString(info.Text)
+		} else {
+			for i, pattern := range rule.TextPatterns {
+				// A pattern can't match text that lacks its required literal
+				if lit := rule.TextPrefilters[i]; lit != "" && !strings.Contains(info.Text, lit) {
+					continue
+				}
+				if details || rule.CaptureGroups {
+					if loc := pattern.FindStringSubmatchIndex(info.Text); loc != nil {
+						if details {
+							detail.TextPattern = &i
+							detail.TextMatch = info.Text[loc[0]:loc[1]]
+						}
+						if rule.CaptureGroups {
+							captures = namedCaptures(pattern, info.Text, loc)
+						}
+						textConditionMet = true
+						break
+					}
+				} else if pattern.MatchString(info.Text) {
+					textConditionMet = true
+					break
+				}
+			}
+		}
+		if !textConditionMet {
+			return fail(StageText)
+		}
+	}
+
+	// 10. Check URL Patterns (if any)
+	if len(rule.UrlPatterns) > 0 {
+		if event.Post == nil {
+			return fail(StageUrl)
+		}
+
+		urlConditionMet := false
+		if event.Post.Embed != nil && event.Post.Embed.External != nil {
+			url := event.Post.Embed.External.URL
+			for i, pattern := range rule.UrlPatterns {
+				if pattern.MatchString(url) {
+					urlConditionMet = true
+					if details {
+						detail.UrlPattern = &i
+					}
+					break
+				}
+			}
+		}
+		if !urlConditionMet {
+			return fail(StageUrl)
+		}
+	}
+
+	// 11. Check External Link Title (posts without a link card never match)
+	if len(rule.ExternalTitlePatterns) > 0 {
+		link := externalLink(event)
+		if link == nil {
+			return fail(StageExternalTitle)
+		}
+		i := matchAny(rule.ExternalTitlePatterns, link.Title)
+		if i < 0 {
+			return fail(StageExternalTitle)
+		}
+		if details {
+			detail.ExternalTitlePattern = &i
+		}
+	}
+
+	// 12. Check External Link Description
+	if len(rule.ExternalDescPatterns) > 0 {
+		link := externalLink(event)
+		if link == nil {
+			return fail(StageExternalDesc)
+		}
+		i := matchAny(rule.ExternalDescPatterns, link.Description)
+		if i < 0 {
+			return fail(StageExternalDesc)
+		}
+		if details {
+			detail.ExternalDescPattern = &i
+		}
+	}
+
+	// 13. Check HasEmbed
+	if rule.HasEmbed != nil {
+		if event.Post == nil {
+			return fail(StageEmbed)
+		}
+		if *rule.HasEmbed != (event.Post.Embed != nil) {
+			return fail(StageEmbed)
+		}
+	}
+
+	// 14. Check Embed Types (if any)
+	if len(rule.EmbedTypes) > 0 {
+		if event.Post == nil {
+			return fail(StageEmbed)
+		}
+
+		embedMatch := false
+		if event.Post.Embed != nil {
+			for _, t := range rule.EmbedTypes {
+				switch {
+				case t == "images" && len(event.Post.Embed.Images) > 0,
+					t == "video" && event.Post.Embed.Video != nil,
+					t == "external" && event.Post.Embed.External != nil,
+					t == "record" && event.Post.Embed.Record != nil:
+					embedMatch = true
+				}
+				if embedMatch {
+					if details {
+						detail.EmbedType = t
+					}
+					break
+				}
+			}
+		}
+
+		if !embedMatch {
+			return fail(StageEmbed)
+		}
+	}
+
+	// 15. Check Mention and Link Counts (other events bypass the check)
+	if event.Post != nil && (rule.MinMentions != nil || rule.MaxMentions != nil || rule.MinLinks != nil || rule.MaxLinks != nil) {
+		mentions := countFacets(event.Post, firefly.MentionFacet)
+		links := countFacets(event.Post, firefly.LinkFacet)
+		if !inBounds(mentions, rule.MinMentions, rule.MaxMentions) || !inBounds(links, rule.MinLinks, rule.MaxLinks) {
+			return fail(StageFacets)
+		}
+	}
+
+	// 16. Check Video Duration and Aspect (posts without a video never match)
+	if rule.MaxVideoSeconds != nil || rule.VideoAspect != "" {
+		video := videoEmbed(event)
+		if video == nil {
+			return fail(StageVideo)
+		}
+		if rule.VideoAspect != "" && videoAspect(video) != rule.VideoAspect {
+			return fail(StageVideo)
+		}
+		if rule.MaxVideoSeconds != nil {
+			// app.bsky.embed.video records don't carry a duration, so there is nothing to compare
+			videoDurationOnce.Do(func() {
+				slog.Debug("Video records have no duration, so maxVideoSeconds has no effect", "rule", rule.Name)
+			})
+		}
+	}
+
+	// 17. Check Image Alt Text (posts without images never match)
+	if rule.AltTextSource != "" || len(rule.AltTextPatterns) > 0 {
+		alts := imageAltTexts(event)
+		if len(alts) == 0 || !altTextAllows(rule.AltTextSource, alts) {
+			return fail(StageAltText)
+		}
+		if len(rule.AltTextPatterns) > 0 {
+			i := -1
+			for _, alt := range alts {
+				if i = matchAny(rule.AltTextPatterns, alt); i >= 0 {
+					break
+				}
+			}
+			if i < 0 {
+				return fail(StageAltText)
+			}
+			if details {
+				detail.AltTextPattern = &i
+			}
+		}
+	}
+
+	// 18. Check Languages (if any)
+	if len(rule.Langs) > 0 {
+		if event.Post == nil {
+			return fail(StageLang)
+		}
+
+		langMatch := false
+		for _, postLang := range event.Post.Languages {
+			for _, ruleLang := range rule.Langs {
+				if postLang == ruleLang {
+					langMatch = true
+					break
+				}
+			}
+			if langMatch {
+				break
+			}
+		}
+		if !langMatch {
+			return fail(StageLang)
+		}
+	}
+
+	// 19. Check IsReply
+	if rule.IsReply != nil {
+		if event.Post == nil {
+			return fail(StageIsReply)
+		}
+
+		isReply := event.Post.ReplyInfo != nil
+		if *rule.IsReply != isReply {
+			return fail(StageIsReply)
+		}
+	}
+
+	// 20. Check Reply Depth
+	if rule.MinReplyDepth != nil {
+		if event.Post == nil || event.Post.ReplyInfo == nil {
+			return fail(StageReplyDepth)
+		}
+		if ReplyDepth(event.Post.ReplyInfo) < *rule.MinReplyDepth {
+			return fail(StageReplyDepth)
+		}
+	}
+
+	// 21. Check Self-Reply
+	if rule.SelfReplyOnly != nil {
+		if event.Post == nil || event.Post.ReplyInfo == nil || event.Post.ReplyInfo.ReplyTarget == nil {
+			return fail(StageSelfReply)
+		}
+		// TargetUserDID is the parent post's author for replies
+		selfReply := info.TargetUserDID == info.AuthorDID
+		if *rule.SelfReplyOnly != selfReply {
+			return fail(StageSelfReply)
+		}
+	}
+
+	// 22. Check Threadgate. Gates are separate records, so these checks match the gate record
+	// itself rather than the post it restricts. Other events only pass hasThreadgate: false
+	// when they are posts.
+	if rule.HasThreadgate != nil {
+		isGate := info.Collection == ThreadgateCollection
+		if *rule.HasThreadgate != isGate || (!isGate && event.Post == nil) {
+			return fail(StageThreadgate)
+		}
+	}
+	if rule.ThreadgateType != "" {
+		if info.Threadgate == nil || !info.Threadgate.Allows(rule.ThreadgateType) {
+			return fail(StageThreadgate)
+		}
+	}
+
+	// 23. Check Time-of-Day Window
+	if rule.TimeWindow != nil {
+		if event.Post == nil {
+			return fail(StageTimeWindow)
+		}
+		if !rule.TimeWindow.Contains(PostTime(event)) {
+			return fail(StageTimeWindow)
+		}
+	}
+
+	// 24. Check Clock Skew
+	backdated := false
+	if rule.MaxClockSkew != nil || rule.MaxBackdate != nil {
+		skew, ok := ClockSkew(event)
+		if !ok {
+			return fail(StageClockSkew)
+		}
+		if rule.MaxClockSkew != nil && skew > *rule.MaxClockSkew {
+			return fail(StageClockSkew)
+		}
+		if rule.MaxBackdate != nil && -skew > *rule.MaxBackdate {
+			backdated = true
+		}
+	}
+
+	// 25. Check Post Age (other events bypass the check)
+	if rule.MaxAge != nil && event.Post != nil {
+		if event.Post.CreatedAt == nil {
+			if !rule.AllowUndated {
+				return fail(StageMaxAge)
+			}
+		} else if time.Since(*event.Post.CreatedAt) > *rule.MaxAge {
+			return fail(StageMaxAge)
+		}
+	}
+
+	// 26. Check Minimum Followers. Profile checks run near the end because they depend on the
+	// profile cache; uncached authors are handled per profileMissPolicy.
+	if rule.MinFollowers != nil {
+		profile, known := info.AuthorProfile()
+		if known && profile.FollowersCount < int64(*rule.MinFollowers) {
+			return fail(StageFollowers)
+		}
+		if !known && !info.Profiles.failOpen {
+			return fail(StageFollowers)
+		}
+	}
+
+	// 27. Check Minimum Account Age. Profiles without a createdAt predate the field, so
+	// those accounts are old enough by definition.
+	if rule.MinAccountAge != nil {
+		profile, known := info.AuthorProfile()
+		if known && !profile.CreatedAt.IsZero() && time.Since(profile.CreatedAt) < *rule.MinAccountAge {
+			return fail(StageAccountAge)
+		}
+		if !known && !info.Profiles.failOpen {
+			return fail(StageAccountAge)
+		}
+	}
+
+	// 28. Check Subject Text. It runs after the cheaper checks because a cache miss starts a
+	// fetch; until the subject is cached the check passes.
+	if len(rule.SubjectTextPatterns) > 0 {
+		uri := info.SubjectPostURI()
+		if uri == "" {
+			return fail(StageSubjectText)
+		}
+		if info.Subjects != nil {
+			if text, known := info.Subjects.Lookup(uri); known {
+				i := matchAny(rule.SubjectTextPatterns, text)
+				if i < 0 {
+					return fail(StageSubjectText)
+				}
+				if details {
+					detail.SubjectTextPattern = &i
+				}
+			}
+		}
+	}
+
+	// 29. Check Custom Matchers. They run last since they may be the most expensive checks.
+	if len(rule.CustomMatchers) > 0 && !rule.matchesCustom(event) {
+		return fail(StageCustomMatcher)
+	}
+
+	return RuleResult{Matched: true, Backdated: backdated, Details: detail, Captures: captures}
+}
+
+// matchesCustom runs the rule's custom matchers, requiring all of them to pass, or any one
+// with CustomMatchAny
+func (rule *CompiledRuleSet) matchesCustom(event *firefly.FirehoseEvent) bool {
+	for _, fn := range rule.CustomMatchers {
+		if fn(event) == rule.CustomMatchAny {
+			return rule.CustomMatchAny
+		}
+	}
+	return !rule.CustomMatchAny
+}
+
+// AuthorAgeHours returns the author's account age in whole hours, if a rule looked up their
+// profile for this event and it has a creation time
+func (info *EventInfo) AuthorAgeHours() (int64, bool) {
+	if info.profile == nil || info.profile.CreatedAt.IsZero() {
+		return 0, false
+	}
+	return int64(time.Since(info.profile.CreatedAt) / time.Hour), true
+}
+
+// AuthorProfile returns the author's cached profile, looking it up at most once per event
+func (info *EventInfo) AuthorProfile() (*Profile, bool) {
+	if info.Profiles == nil {
+		return nil, false
+	}
+	if !info.profileChecked {
+		info.profile, _ = info.Profiles.Lookup(info.AuthorDID)
+		info.profileChecked = true
+	}
+	return info.profile, info.profile != nil
+}
+
+// ReplyDepth returns a proxy for how deep a reply is in its thread. Only the parent and root are
+// known, so this is 1 for direct replies to the root and 2 for anything deeper.
+func ReplyDepth(reply *firefly.ReplyInfo) int {
+	if reply.ReplyTarget == nil || reply.ReplyRoot == nil {
+		return 1
+	}
+	if reply.ReplyTarget.URI == reply.ReplyRoot.URI {
+		return 1
+	}
+	return 2
+}
+
+// ThreadgateCollection is the collection of records restricting who can reply to a post
+const ThreadgateCollection = "app.bsky.feed.threadgate"
+
+// Threadgate types for threadgateType rules. Nobody and Anyone describe the gate as a whole;
+// the rest name the allow rules a gate can combine.
+const (
+	ThreadgateNobody    = "nobody"    // An empty allow list: replies are disabled
+	ThreadgateAnyone    = "anyone"    // No allow list: the gate only hides replies
+	ThreadgateMention   = "mention"   // Accounts mentioned in the post can reply
+	ThreadgateFollowing = "following" // Accounts the author follows can reply
+	ThreadgateFollowers = "followers" // Accounts following the author can reply
+	ThreadgateList      = "list"      // Members of a list can reply
+)
+
+// threadgateRules maps allow rule $types to threadgate types
+var threadgateRules = map[string]string{
+	"app.bsky.feed.threadgate#mentionRule":   ThreadgateMention,
+	"app.bsky.feed.threadgate#followingRule": ThreadgateFollowing,
+	"app.bsky.feed.threadgate#followerRule":  ThreadgateFollowers,
+	"app.bsky.feed.threadgate#listRule":      ThreadgateList,
+}
+
+// Threadgate is the part of an app.bsky.feed.threadgate record rules match on
+type Threadgate struct {
+	Types  []string // The allow rules, as threadgate types; unrecognized rules are left out
+	Open   bool     // The gate has no allow list, so anyone can reply
+	Closed bool     // The allow list is empty, so nobody can reply
+}
+
+// parseThreadgate decodes a threadgate record, returning nil if it can't be parsed
+func parseThreadgate(record json.RawMessage) *Threadgate {
+	if len(record) == 0 {
+		return nil
+	}
+	var raw struct {
+		Allow *[]struct {
+			Type string `json:"$type"`
+		} `json:"allow"`
+	}
+	if err := json.Unmarshal(record, &raw); err != nil {
+		return nil
+	}
+	gate := &Threadgate{Open: raw.Allow == nil}
+	if raw.Allow != nil {
+		gate.Closed = len(*raw.Allow) == 0
+		for _, rule := range *raw.Allow {
+			if t, ok := threadgateRules[rule.Type]; ok {
+				gate.Types = append(gate.Types, t)
+			}
+		}
+	}
+	return gate
+}
+
+// Allows reports whether the gate is of the given threadgate type
+func (g *Threadgate) Allows(t string) bool {
+	switch t {
+	case ThreadgateNobody:
+		return g.Closed
+	case ThreadgateAnyone:
+		return g.Open
+	}
+	return slices.Contains(g.Types, t)
+}
+
+// countFacets returns the number of a post's facets of the given type
+func countFacets(post *firefly.FeedPost, facetType firefly.FacetType) int {
+	n := 0
+	for _, facet := range post.Facets {
+		if facet.Type == facetType {
+			n++
+		}
+	}
+	return n
+}
+
+// inBounds reports whether n is within the bounds that are set
+func inBounds(n int, lo, hi *int) bool {
+	return (lo == nil || n >= *lo) && (hi == nil || n <= *hi)
+}
+
+// IsCollectionGlob reports whether a collection pattern is "*" or a trailing-glob such as "app.bsky.graph.*"
+func IsCollectionGlob(pattern string) bool {
+	return strings.HasSuffix(pattern, "*")
+}
+
+// MatchCollection reports whether a collection matches a pattern. "*" matches everything,
+// a trailing "*" matches by prefix, and anything else must match exactly.
+func MatchCollection(pattern, collection string) bool {
+	if IsCollectionGlob(pattern) {
+		return strings.HasPrefix(collection, strings.TrimSuffix(pattern, "*"))
+	}
+	return pattern == collection
+}
+
+// TimeWindow is a daily time-of-day range, stored as minutes since midnight in Location
+type TimeWindow struct {
+	Start    int
+	End      int
+	Location *time.Location
+}
+
+// What maxAgeSeconds does with a post whose createdAt is missing or couldn't be parsed
+const (
+	UndatedReject = "reject" // Fail the check (default)
+	UndatedAllow  = "allow"  // Skip the check
+)
+
+// maxCreatedAtDrift is how far a post's createdAt may differ from the firehose event time
+// before it is considered bogus
+const maxCreatedAtDrift = 24 * time.Hour
+
+// ParseTimeWindow parses "HH:MM" start and end times and an optional IANA timezone
+func ParseTimeWindow(start, end, timezone string) (*TimeWindow, error) {
+	parseClock := func(value string) (int, error) {
+		t, err := time.Parse("15:04", value)
+		if err != nil {
+			return 0, fmt.Errorf("invalid time '%s', expected HH:MM", value)
+		}
+		return t.Hour()*60 + t.Minute(), nil
+	}
+
+	startMinutes, err := parseClock(start)
+	if err != nil {
+		return nil, err
+	}
+	endMinutes, err := parseClock(end)
+	if err != nil {
+		return nil, err
+	}
+
+	location := time.UTC
+	if timezone != "" {
+		location, err = time.LoadLocation(timezone)
+		if err != nil {
+			return nil, fmt.Errorf("invalid timezone '%s': %w", timezone, err)
+		}
+	}
+
+	return &TimeWindow{Start: startMinutes, End: endMinutes, Location: location}, nil
+}
+
+// Contains reports whether t falls within the window. Windows with End before Start wrap past midnight.
+func (tw *TimeWindow) Contains(t time.Time) bool {
+	local := t.In(tw.Location)
+	minutes := local.Hour()*60 + local.Minute()
+	if tw.Start <= tw.End {
+		return minutes >= tw.Start && minutes < tw.End
+	}
+	return minutes >= tw.Start || minutes < tw.End
+}
+
+// PostTime returns the post's createdAt, falling back to the firehose event time when
+// createdAt is missing or implausibly far from it
+func PostTime(event *firefly.FirehoseEvent) time.Time {
+	if event.Post != nil && event.Post.CreatedAt != nil {
+		createdAt := *event.Post.CreatedAt
+		drift := createdAt.Sub(event.Timestamp)
+		if drift < maxCreatedAtDrift && drift > -maxCreatedAtDrift {
+			return createdAt
+		}
+	}
+	return event.Timestamp
+}
+
+// ClockSkew returns how far the post's createdAt is ahead of server time (negative when backdated).
+// ok is false for events without a post creation time.
+func ClockSkew(event *firefly.FirehoseEvent) (skew time.Duration, ok bool) {
+	if event.Post == nil || event.Post.CreatedAt == nil {
+		return 0, false
+	}
+	return time.Until(*event.Post.CreatedAt), true
+}
+
+// RequiredLiteral returns the longest literal substring that every match of pattern must
+// contain, or "" if none can be extracted. Case-insensitive literals are skipped, since
+// checking them would cost as much as the regex itself.
+func RequiredLiteral(pattern string) string {
+	re, err := syntax.Parse(pattern, syntax.Perl)
+	if err != nil {
+		return ""
+	}
+	return requiredLiteral(re.Simplify())
+}
+
+func requiredLiteral(re *syntax.Regexp) string {
+	switch re.Op {
+	case syntax.OpLiteral:
+		if re.Flags&syntax.FoldCase != 0 {
+			return ""
+		}
+		return string(re.Rune)
+	case syntax.OpCapture:
+		return requiredLiteral(re.Sub[0])
+	case syntax.OpConcat:
+		// Every part of a concatenation is required, so any part's literal will do
+		longest := ""
+		for _, sub := range re.Sub {
+			if lit := requiredLiteral(sub); len(lit) > len(longest) {
+				longest = lit
+			}
+		}
+		return longest
+	}
+	return ""
+}
+
+// textPrefilterPasses reports whether the text could match any of the rule's text patterns.
+// It only rules text out when every pattern has a required literal and none are present.
+func (rule *CompiledRuleSet) textPrefilterPasses(text string) bool {
+	for _, lit := range rule.TextPrefilters {
+		if lit == "" || strings.Contains(text, lit) {
+			return true
+		}
+	}
+	return false
+}
+
+// CompileRulePattern compiles a rule's regex, rejecting it when its compiled program has more
+// than maxProgram instructions. RE2 never backtracks, but the cost of each match still grows
+// with program size, and a single huge pattern (such as an alternation of thousands of words)
+// runs on every event and can slow the whole worker pool. Returns the program size so callers
+// can report it.
+func CompileRulePattern(pattern string, maxProgram int) (*regexp.Regexp, int, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, 0, err
+	}
+	// regexp doesn't expose its program, so compile it again through syntax to measure it
+	parsed, err := syntax.Parse(pattern, syntax.Perl)
+	if err != nil {
+		return nil, 0, err
+	}
+	prog, err := syntax.Compile(parsed.Simplify())
+	if err != nil {
+		return nil, 0, err
+	}
+	size := len(prog.Inst)
+	if size > maxProgram {
+		return nil, size, fmt.Errorf("compiled program has %d instructions, more than maxRegexProgramSize (%d)", size, maxProgram)
+	}
+	return re, size, nil
+}
+
+// CombinePatterns joins patterns into a single alternation so RE2 can test them all in one
+// pass. Each pattern is wrapped in a non-capturing group, which scopes inline flags like
+// (?i) and anchors to that pattern. Returns nil when the patterns can't be combined safely
+// (e.g. a \Q without a closing \E swallows the rest of the expression), in which case
+// callers should match the patterns one by one.
+func CombinePatterns(patterns []string) *regexp.Regexp {
+	if len(patterns) < 2 {
+		return nil
+	}
+
+	groups := make([]string, len(patterns))
+	subexps := 0
+	for i, p := range patterns {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return nil
+		}
+		subexps += re.NumSubexp()
+		groups[i] = "(?:" + p + ")"
+	}
+
+	combined, err := regexp.Compile(strings.Join(groups, "|"))
+	if err != nil || combined.NumSubexp() != subexps {
+		return nil
+	}
+	return combined
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+
+	"github.com/TheAlyxGreen/firefly"
+)
+
+// MatcherFunc is a custom match condition written in Go, for logic a rule's config can't
+// express. It runs on a worker for every event that passes the rule's other checks, so it
+// must be fast and must not block: no network calls or locks held for long. Anything slow,
+// such as calling a classifier, belongs behind a cache the matcher only reads from.
+type MatcherFunc func(*firefly.FirehoseEvent) bool
+
+// Ways a rule combines its customMatchers
+const (
+	CustomMatchAll = "all" // Every matcher must return true
+	CustomMatchAny = "any" // At least one matcher must return true
+)
+
+// customMatchers holds the registered matchers by name. It is only written during package
+// initialization, so reads need no locking.
+var customMatchers = make(map[string]MatcherFunc)
+
+// RegisterMatcher makes a matcher available to rules as name in customMatchers. Call it from
+// an init function in a file added to this package; registering after startup has no
+// effect on loaded rules. It panics if name is empty or already registered, or fn is nil.
+func RegisterMatcher(name string, fn MatcherFunc) {
+	if name == "" {
+		panic("RegisterMatcher: empty matcher name")
+	}
+	if fn == nil {
+		panic("RegisterMatcher: nil matcher " + name)
+	}
+	if _, dup := customMatchers[name]; dup {
+		panic("RegisterMatcher: matcher " + name + " registered twice")
+	}
+	customMatchers[name] = fn
+}
+
+// lookupMatchers returns the registered matchers for the given names, in order
+func lookupMatchers(names []string) ([]MatcherFunc, error) {
+	fns := make([]MatcherFunc, 0, len(names))
+	for _, name := range names {
+		fn, ok := customMatchers[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown custom matcher %q, registered: %v", name, slices.Sorted(maps.Keys(customMatchers)))
+		}
+		fns = append(fns, fn)
+	}
+	return fns, nil
+}
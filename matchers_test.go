@@ -0,0 +1,119 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"unicode"
+
+	"github.com/TheAlyxGreen/firefly"
+	"github.com/bluesky-social/jetstream/pkg/models"
+)
+
+// isShouting is an example matcher: posts with at least 10 letters, all of them uppercase
+func isShouting(event *firefly.FirehoseEvent) bool {
+	if event.Post == nil {
+		return false
+	}
+	letters := 0
+	for _, r := range event.Post.Text {
+		if !unicode.IsLetter(r) {
+			continue
+		}
+		if unicode.IsLower(r) {
+			return false
+		}
+		letters++
+	}
+	return letters >= 10
+}
+
+// registerForTest registers a matcher for the rest of the test only
+func registerForTest(t *testing.T, name string, fn MatcherFunc) {
+	t.Helper()
+	RegisterMatcher(name, fn)
+	t.Cleanup(func() { delete(customMatchers, name) })
+}
+
+func postEvent(text string) *firefly.FirehoseEvent {
+	return &firefly.FirehoseEvent{
+		Type: firefly.EventTypePost,
+		Repo: "did:plc:poster",
+		Post: &firefly.FeedPost{Text: text},
+		RawCommit: &models.Event{
+			Did:    "did:plc:poster",
+			Kind:   "commit",
+			Commit: &models.Commit{Operation: "create", Collection: "app.bsky.feed.post", RKey: "a"},
+		},
+	}
+}
+
+func TestCustomMatcherModes(t *testing.T) {
+	registerForTest(t, "shouting", isShouting)
+	registerForTest(t, "question", func(event *firefly.FirehoseEvent) bool {
+		return event.Post != nil && strings.HasSuffix(event.Post.Text, "?")
+	})
+	fns, err := lookupMatchers([]string{"shouting", "question"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		text     string
+		all, any bool
+	}{
+		{"WHY IS EVERYTHING ON FIRE?", true, true},
+		{"WHAT A LOVELY MORNING", false, true},
+		{"is anyone awake?", false, true},
+		{"just a quiet post", false, false},
+	}
+	for _, tt := range tests {
+		info := DescribeEvent(postEvent(tt.text))
+		for _, mode := range []struct {
+			any  bool
+			want bool
+		}{{false, tt.all}, {true, tt.any}} {
+			rule := CompiledRuleSet{Name: "custom", CustomMatchers: fns, CustomMatchAny: mode.any}
+			result := rule.Evaluate(info, false)
+			if result.Matched != mode.want {
+				t.Errorf("%q with customMatchAny=%v: matched %v, want %v", tt.text, mode.any, result.Matched, mode.want)
+			}
+			if !result.Matched && result.FailedStage != StageCustomMatcher {
+				t.Errorf("%q with customMatchAny=%v: failed at %q, want %q", tt.text, mode.any, result.FailedStage, StageCustomMatcher)
+			}
+		}
+	}
+}
+
+func TestLookupUnknownMatcher(t *testing.T) {
+	registerForTest(t, "shouting", isShouting)
+	_, err := lookupMatchers([]string{"shouting", "whispering"})
+	if err == nil || !strings.Contains(err.Error(), "whispering") || !strings.Contains(err.Error(), "shouting") {
+		t.Errorf("got error %v, want one naming the unknown matcher and listing registered ones", err)
+	}
+}
+
+func TestRegisterMatcherPanics(t *testing.T) {
+	registerForTest(t, "taken", isShouting)
+	tests := []struct {
+		desc string
+		name string
+		fn   MatcherFunc
+	}{
+		{"empty name", "", isShouting},
+		{"nil matcher", "nothing", nil},
+		{"duplicate name", "taken", isShouting},
+	}
+	for _, tt := range tests {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("%s: RegisterMatcher didn't panic", tt.desc)
+				}
+			}()
+			RegisterMatcher(tt.name, tt.fn)
+		}()
+	}
+	if _, registered := customMatchers["nothing"]; registered {
+		t.Error("a nil matcher was registered")
+	}
+}
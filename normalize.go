@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// Text normalizations applied to post text before matching
+const (
+	NormalizeLowercase      = "lowercase"
+	NormalizeStripZeroWidth = "stripZeroWidth"
+	NormalizeNFKC           = "nfkc"
+)
+
+// zeroWidth removes invisible characters that spammers insert into words to slip past keyword
+// rules: zero-width spaces and joiners, word joiners and invisible operators, the byte order
+// mark, soft hyphens, and the Mongolian vowel separator
+var zeroWidth = strings.NewReplacer(
+	"\u200b", "", "\u200c", "", "\u200d", "",
+	"\u2060", "", "\u2061", "", "\u2062", "", "\u2063", "", "\u2064", "",
+	"\ufeff", "", "\u00ad", "", "\u180e", "",
+)
+
+// TextNormalizer transforms post text before rules match against it. The broadcast keeps the
+// original text; only the copy rules see is changed.
+type TextNormalizer []func(string) string
+
+// NewTextNormalizer builds a normalizer that applies the named transforms in order
+func NewTextNormalizer(names []string) (TextNormalizer, error) {
+	var n TextNormalizer
+	for _, name := range names {
+		switch name {
+		case NormalizeLowercase:
+			n = append(n, strings.ToLower)
+		case NormalizeStripZeroWidth:
+			n = append(n, zeroWidth.Replace)
+		case NormalizeNFKC:
+			n = append(n, norm.NFKC.String)
+		default:
+			return nil, fmt.Errorf("unknown text normalization %q, expected %q, %q, or %q", name, NormalizeLowercase, NormalizeStripZeroWidth, NormalizeNFKC)
+		}
+	}
+	return n, nil
+}
+
+// Apply returns text with every transform applied
+func (n TextNormalizer) Apply(text string) string {
+	for _, transform := range n {
+		text = transform(text)
+	}
+	return text
+}
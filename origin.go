@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// OriginPolicy decides which browser origins may open websockets, from the allowedOrigins
+// config. Origins are compared by parsed scheme, host, and port rather than as strings, so
+// "https://example.com.evil.net" can't pass for example.com.
+type OriginPolicy struct {
+	allowAll  bool
+	allowNull bool // The "null" origin sent by file:// pages and sandboxed iframes
+	patterns  []originPattern
+}
+
+type originPattern struct {
+	scheme    string // "http" or "https"; empty allows either
+	host      string // Lowercased; for wildcards, the domain the subdomains belong to
+	port      string // Empty means the scheme's default port
+	subdomain bool   // Matches any subdomain of host, but not host itself
+}
+
+// NewOriginPolicy parses allowedOrigins entries: "*", "null", or a host optionally prefixed
+// with a scheme and followed by a port, where the host may start with "*." to match any
+// subdomain. No entries allows every origin.
+func NewOriginPolicy(entries []string) (*OriginPolicy, error) {
+	p := &OriginPolicy{allowAll: len(entries) == 0}
+	for _, entry := range entries {
+		switch entry {
+		case "*":
+			p.allowAll = true
+			continue
+		case "null":
+			p.allowNull = true
+			continue
+		}
+
+		var pattern originPattern
+		rest := entry
+		if scheme, after, ok := strings.Cut(entry, "://"); ok {
+			if scheme != "http" && scheme != "https" {
+				return nil, fmt.Errorf("allowedOrigins entry %q: scheme must be http or https", entry)
+			}
+			pattern.scheme, rest = scheme, after
+		}
+		if strings.ContainsAny(rest, "/?#") {
+			return nil, fmt.Errorf("allowedOrigins entry %q: must be a scheme and host, without a path", entry)
+		}
+		// Parse the host and port the same way incoming origins are
+		u, err := url.Parse("http://" + rest)
+		if err != nil || u.Hostname() == "" || u.User != nil {
+			return nil, fmt.Errorf("allowedOrigins entry %q: invalid host", entry)
+		}
+		pattern.host, pattern.port = strings.ToLower(u.Hostname()), u.Port()
+		if domain, ok := strings.CutPrefix(pattern.host, "*."); ok {
+			pattern.host, pattern.subdomain = domain, true
+		}
+		if pattern.host == "" || strings.Contains(pattern.host, "*") {
+			return nil, fmt.Errorf("allowedOrigins entry %q: a wildcard must be a leading \"*.\"", entry)
+		}
+		p.patterns = append(p.patterns, pattern)
+	}
+	return p, nil
+}
+
+// Allows reports whether a request's Origin header value is permitted
+func (p *OriginPolicy) Allows(origin string) bool {
+	if p.allowAll {
+		return true
+	}
+	if origin == "null" {
+		return p.allowNull
+	}
+	u, err := url.Parse(origin)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return false
+	}
+	host, port := strings.ToLower(u.Hostname()), u.Port()
+	for _, pattern := range p.patterns {
+		if pattern.scheme != "" && pattern.scheme != u.Scheme {
+			continue
+		}
+		if pattern.port != port {
+			continue
+		}
+		if pattern.subdomain {
+			if strings.HasSuffix(host, "."+pattern.host) {
+				return true
+			}
+		} else if host == pattern.host {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckOrigin implements websocket.Upgrader's CheckOrigin. Requests without an Origin header
+// come from non-browser clients, which aren't subject to origin checks.
+func (p *OriginPolicy) CheckOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	return p.Allows(origin)
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"unicode/utf8"
+
+	"github.com/TheAlyxGreen/firefly"
+	"github.com/bluesky-social/jetstream/pkg/models"
+)
+
+// truncatedSuffix marks text cut short by maxTextBytes
+const truncatedSuffix = "…"
+
+// redactedRecordFields are removed from records matched by a redactText rule. Facets are
+// dropped along with the text since their mentions and links reveal parts of it.
+var redactedRecordFields = []string{"embed", "facets"}
+
+// redactPayload returns a copy of an event's broadcast payload with the record's text blanked
+// and its embeds and facets removed, along with the text's length in characters. The event
+// itself is left untouched, since other sinks and rules share it.
+func redactPayload(event *firefly.FirehoseEvent) (any, int) {
+	if event.RawCommit == nil {
+		if event.Post == nil {
+			return event, 0
+		}
+		redacted := *event
+		redacted.Post = nil
+		return &redacted, utf8.RuneCountInString(event.Post.Text)
+	}
+
+	commit := event.RawCommit.Commit
+	if commit == nil || len(commit.Record) == 0 {
+		return event.RawCommit, 0
+	}
+
+	var record map[string]json.RawMessage
+	if err := json.Unmarshal(commit.Record, &record); err != nil {
+		// A record that can't be inspected can't be shown safely
+		return withRecord(event.RawCommit, nil), 0
+	}
+	length := 0
+	if raw, ok := record["text"]; ok {
+		var text string
+		json.Unmarshal(raw, &text)
+		length = utf8.RuneCountInString(text)
+		record["text"] = json.RawMessage(`""`)
+	}
+	for _, field := range redactedRecordFields {
+		delete(record, field)
+	}
+	redacted, _ := json.Marshal(record)
+	return withRecord(event.RawCommit, redacted), length
+}
+
+// truncateRecord cuts a commit event's record down for broadcast: text longer than maxTextBytes
+// is cut at a character boundary and marked with truncatedSuffix, and facets and embedded images
+// beyond maxItems are dropped. A limit of 0 disables it. ok is false when nothing needed cutting.
+func truncateRecord(event *firefly.FirehoseEvent, maxTextBytes, maxItems int) (record json.RawMessage, ok bool) {
+	if event.RawCommit == nil || event.RawCommit.Commit == nil {
+		return nil, false
+	}
+	raw := event.RawCommit.Commit.Record
+	if maxItems == 0 && len(raw) <= maxTextBytes {
+		return nil, false // Encoded text is never shorter than the text itself, so it fits
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &fields); err != nil {
+		return nil, false
+	}
+
+	if maxTextBytes > 0 {
+		var text string
+		if encoded, found := fields["text"]; found && json.Unmarshal(encoded, &text) == nil && len(text) > maxTextBytes {
+			cut := maxTextBytes
+			for cut > 0 && !utf8.RuneStart(text[cut]) {
+				cut--
+			}
+			fields["text"], _ = json.Marshal(text[:cut] + truncatedSuffix)
+			ok = true
+		}
+	}
+	if maxItems > 0 {
+		if capList(fields, "facets", maxItems) {
+			ok = true
+		}
+		if embed, cut := capEmbedImages(fields["embed"], maxItems); cut {
+			fields["embed"] = embed
+			ok = true
+		}
+	}
+	if !ok {
+		return nil, false
+	}
+	record, _ = json.Marshal(fields)
+	return record, true
+}
+
+// capEmbedImages drops images beyond limit from an embed, including the media of a recordWithMedia embed
+func capEmbedImages(raw json.RawMessage, limit int) (json.RawMessage, bool) {
+	var embed map[string]json.RawMessage
+	if len(raw) == 0 || json.Unmarshal(raw, &embed) != nil {
+		return raw, false
+	}
+	cut := capList(embed, "images", limit)
+	if media, mediaCut := capEmbedImages(embed["media"], limit); mediaCut {
+		embed["media"] = media
+		cut = true
+	}
+	if !cut {
+		return raw, false
+	}
+	capped, _ := json.Marshal(embed)
+	return capped, true
+}
+
+// capList drops entries beyond limit from the JSON array fields[key], reporting whether any were dropped
+func capList(fields map[string]json.RawMessage, key string, limit int) bool {
+	var items []json.RawMessage
+	if json.Unmarshal(fields[key], &items) != nil || len(items) <= limit {
+		return false
+	}
+	fields[key], _ = json.Marshal(items[:limit])
+	return true
+}
+
+// withRecord returns a copy of a commit event with its record replaced, leaving the original untouched
+func withRecord(event *models.Event, record json.RawMessage) *models.Event {
+	copied := *event
+	commit := *event.Commit
+	commit.Record = record
+	copied.Commit = &commit
+	return &copied
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Policies for rules that need an author's profile when it isn't cached yet
+const (
+	ProfileMissAllow  = "allow"  // Fail open: skip profile conditions until the profile is cached
+	ProfileMissReject = "reject" // Fail closed: treat profile conditions as failed until it is cached
+)
+
+// Profile is the subset of an author's profile used for quality filters
+type Profile struct {
+	FollowersCount int64
+	CreatedAt      time.Time // Zero if the profile doesn't say
+}
+
+// ProfileCache maps DIDs to profiles fetched with app.bsky.actor.getProfile, using a bounded,
+// TTL-based cache. Like HandleResolver, lookups never block: a miss schedules a background
+// fetch and reports the profile as unknown.
+type ProfileCache struct {
+	client     *http.Client
+	server     string
+	ttl        time.Duration
+	maxEntries int
+	failOpen   bool // Whether rules pass profile conditions for authors that aren't cached
+
+	mu      sync.Mutex
+	entries map[string]profileEntry
+	pending map[string]bool
+
+	sem chan struct{} // Bounds concurrent fetches
+}
+
+type profileEntry struct {
+	profile *Profile // nil if the fetch failed
+	expires time.Time
+}
+
+func NewProfileCache(server string, ttl time.Duration, maxEntries, concurrency int, missPolicy string) *ProfileCache {
+	return &ProfileCache{
+		client:     &http.Client{Timeout: 10 * time.Second},
+		server:     strings.TrimSuffix(server, "/"),
+		ttl:        ttl,
+		maxEntries: maxEntries,
+		failOpen:   missPolicy != ProfileMissReject,
+		entries:    make(map[string]profileEntry),
+		pending:    make(map[string]bool),
+		sem:        make(chan struct{}, concurrency),
+	}
+}
+
+// Lookup returns the cached profile for a DID. On a miss it schedules a background fetch
+// (unless the cache is already at its concurrency limit) and returns false.
+func (c *ProfileCache) Lookup(did string) (*Profile, bool) {
+	if did == "" {
+		return nil, false
+	}
+
+	c.mu.Lock()
+	entry, ok := c.entries[did]
+	if ok && time.Now().Before(entry.expires) {
+		c.mu.Unlock()
+		return entry.profile, entry.profile != nil
+	}
+	if c.pending[did] {
+		c.mu.Unlock()
+		return nil, false
+	}
+
+	// Try to claim a fetch slot without blocking
+	select {
+	case c.sem <- struct{}{}:
+	default:
+		c.mu.Unlock()
+		return nil, false
+	}
+	c.pending[did] = true
+	c.mu.Unlock()
+
+	go func() {
+		defer func() { <-c.sem }()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		profile, err := c.Fetch(ctx, did)
+		if err != nil {
+			slog.Debug("Error fetching profile", "did", did, "error", err)
+		}
+
+		// Failures are cached as nil so a broken DID isn't retried on every event
+		c.store(did, profile)
+
+		c.mu.Lock()
+		delete(c.pending, did)
+		c.mu.Unlock()
+	}()
+
+	return nil, false
+}
+
+// store caches a profile for a DID, evicting entries if the cache is full
+func (c *ProfileCache) store(did string, profile *Profile) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, exists := c.entries[did]; !exists && len(c.entries) >= c.maxEntries {
+		c.evictLocked()
+	}
+	c.entries[did] = profileEntry{profile: profile, expires: time.Now().Add(c.ttl)}
+}
+
+// evictLocked removes expired entries, or an arbitrary entry if none have expired.
+// Callers must hold c.mu.
+func (c *ProfileCache) evictLocked() {
+	now := time.Now()
+	evicted := false
+	for did, entry := range c.entries {
+		if now.After(entry.expires) {
+			delete(c.entries, did)
+			evicted = true
+		}
+	}
+	if evicted {
+		return
+	}
+	for did := range c.entries {
+		delete(c.entries, did)
+		return
+	}
+}
+
+// Fetch retrieves a profile with app.bsky.actor.getProfile
+func (c *ProfileCache) Fetch(ctx context.Context, did string) (*Profile, error) {
+	endpoint := c.server + "/xrpc/app.bsky.actor.getProfile?actor=" + url.QueryEscape(did)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %d fetching profile for %s", resp.StatusCode, did)
+	}
+
+	var out struct {
+		FollowersCount int64  `json:"followersCount"`
+		CreatedAt      string `json:"createdAt"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return nil, err
+	}
+
+	profile := &Profile{FollowersCount: out.FollowersCount}
+	if t, err := time.Parse(time.RFC3339, out.CreatedAt); err == nil {
+		profile.CreatedAt = t
+	}
+	return profile, nil
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// TokenBucket allows up to rate events per second on average, with bursts of up to one
+// second's worth. Tokens are refilled lazily on each call rather than by a ticker.
+type TokenBucket struct {
+	rate  float64 // Tokens added per second
+	burst float64 // Most tokens the bucket holds
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func NewTokenBucket(rate int) *TokenBucket {
+	return &TokenBucket{
+		rate:   float64(rate),
+		burst:  float64(rate),
+		tokens: float64(rate),
+		last:   time.Now(),
+	}
+}
+
+// Allow takes a token if one is available, reporting whether it did
+func (b *TokenBucket) Allow(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.tokens = min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
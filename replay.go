@@ -0,0 +1,326 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Limits on how many matches one /recent request returns
+const (
+	defaultRecentLimit = 100
+	maxRecentLimit     = 1000
+)
+
+// replayPersistInterval is how often a persisted replay buffer is saved while running, in case
+// the process dies without a clean shutdown
+const replayPersistInterval = time.Minute
+
+// maxPersistedEntryBytes guards against a corrupt length prefix allocating a huge record
+const maxPersistedEntryBytes = 16 << 20
+
+// ReplayBuffer is a Sink that keeps the most recent matches in memory, each tagged with a
+// sequence number clients use as a cursor. Sequences start at the server's start time in
+// microseconds and count up by one per match, so a cursor from before a restart is always
+// older than anything in the buffer and reads as having fallen behind. Matches restored by
+// Load keep their sequences, so cursors into them stay valid across the restart.
+type ReplayBuffer struct {
+	mu      sync.RWMutex
+	entries []replayEntry // Ring buffer, oldest entry at start once full
+	start   int
+	nextSeq int64
+	saved   int64 // nextSeq as of the last Save, to skip saving an unchanged buffer
+}
+
+type replayEntry struct {
+	seq     int64
+	message hubMessage
+}
+
+func NewReplayBuffer(size int) *ReplayBuffer {
+	return &ReplayBuffer{
+		entries: make([]replayEntry, 0, size),
+		nextSeq: time.Now().UnixMicro(),
+	}
+}
+
+// Send implements Sink by recording the match, evicting the oldest one when full
+func (rb *ReplayBuffer) Send(msg BroadcastMessage) {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		slog.Error("Error marshaling replay message", "error", err)
+		return
+	}
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+
+	entry := replayEntry{seq: rb.nextSeq, message: hubMessage{data: data, names: slices.Concat(msg.MatchedRules, msg.MatchedGroups)}}
+	rb.nextSeq++
+	if len(rb.entries) < cap(rb.entries) {
+		rb.entries = append(rb.entries, entry)
+		return
+	}
+	rb.entries[rb.start] = entry
+	rb.start = (rb.start + 1) % len(rb.entries)
+}
+
+// Len returns the number of matches in the buffer
+func (rb *ReplayBuffer) Len() int {
+	rb.mu.RLock()
+	defer rb.mu.RUnlock()
+	return len(rb.entries)
+}
+
+// persistedHeader is the first record of a persisted replay buffer
+type persistedHeader struct {
+	SchemaVersion int `json:"schemaVersion"`
+	Count         int `json:"count"`
+}
+
+// persistedEntry is one match in a persisted replay buffer
+type persistedEntry struct {
+	Seq     int64           `json:"seq"`
+	Names   []string        `json:"names"`
+	Message json.RawMessage `json:"message"`
+}
+
+// Save writes the buffer to path as gzip-compressed, length-prefixed JSON records: a
+// persistedHeader, then the matches oldest first. It writes a temporary file and renames it
+// over path, so a crash mid-save leaves the previous file intact.
+func (rb *ReplayBuffer) Save(path string) error {
+	rb.mu.RLock()
+	entries := make([]replayEntry, 0, len(rb.entries))
+	for i := range rb.entries {
+		entries = append(entries, rb.entries[(rb.start+i)%len(rb.entries)])
+	}
+	nextSeq := rb.nextSeq
+	rb.mu.RUnlock()
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // Fails harmlessly once renamed
+
+	zw := gzip.NewWriter(tmp)
+	w := bufio.NewWriter(zw)
+	err = writePersistedRecord(w, persistedHeader{SchemaVersion: SchemaVersion, Count: len(entries)})
+	for _, entry := range entries {
+		if err != nil {
+			break
+		}
+		err = writePersistedRecord(w, persistedEntry{Seq: entry.seq, Names: entry.message.names, Message: entry.message.data})
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = zw.Close()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+
+	rb.mu.Lock()
+	rb.saved = nextSeq
+	rb.mu.Unlock()
+	return nil
+}
+
+// Load restores matches saved by Save, keeping the newest that fit. A missing file is not an
+// error. A file from another schemaVersion is discarded, since its messages no longer match
+// what clients expect; a corrupt file is an error and loads nothing.
+func (rb *ReplayBuffer) Load(path string) error {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		return err
+	}
+	r := bufio.NewReader(zr)
+
+	var header persistedHeader
+	if err := readPersistedRecord(r, &header); err != nil {
+		return fmt.Errorf("reading header: %w", err)
+	}
+	if header.SchemaVersion != SchemaVersion {
+		slog.Warn("Discarding persisted replay buffer from another schema version", "path", path, "schemaVersion", header.SchemaVersion, "current", SchemaVersion)
+		return nil
+	}
+	entries := make([]replayEntry, 0, min(header.Count, cap(rb.entries)))
+	for range header.Count {
+		var pe persistedEntry
+		if err := readPersistedRecord(r, &pe); err != nil {
+			return fmt.Errorf("reading match %d of %d: %w", len(entries)+1, header.Count, err)
+		}
+		entries = append(entries, replayEntry{seq: pe.Seq, message: hubMessage{data: pe.Message, names: pe.Names}})
+	}
+
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	if excess := len(entries) - cap(rb.entries); excess > 0 {
+		entries = entries[excess:]
+	}
+	rb.entries = append(rb.entries[:0], entries...)
+	rb.start = 0
+	if len(entries) > 0 {
+		rb.nextSeq = max(rb.nextSeq, entries[len(entries)-1].seq+1)
+	}
+	rb.saved = rb.nextSeq
+	return nil
+}
+
+// PersistPeriodically saves the buffer to path every replayPersistInterval when it has changed,
+// until ctx is cancelled
+func (rb *ReplayBuffer) PersistPeriodically(ctx context.Context, path string) {
+	ticker := time.NewTicker(replayPersistInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			rb.mu.RLock()
+			changed := rb.nextSeq != rb.saved
+			rb.mu.RUnlock()
+			if !changed {
+				continue
+			}
+			if err := rb.Save(path); err != nil {
+				slog.Warn("Failed to persist replay buffer", "path", path, "error", err)
+			}
+		}
+	}
+}
+
+func writePersistedRecord(w io.Writer, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.BigEndian, uint32(len(data))); err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+func readPersistedRecord(r io.Reader, v any) error {
+	var n uint32
+	if err := binary.Read(r, binary.BigEndian, &n); err != nil {
+		return err
+	}
+	if n > maxPersistedEntryBytes {
+		return fmt.Errorf("record of %d bytes exceeds the %d byte limit", n, maxPersistedEntryBytes)
+	}
+	data := make([]byte, n)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// Since returns up to limit matches newer than cursor that the filter wants (nil wants all),
+// oldest first, and the cursor to poll with next. behind is true when matches after cursor
+// have already been evicted, so the client missed some and should resync.
+func (rb *ReplayBuffer) Since(cursor int64, limit int, filter *hubClient) (messages []json.RawMessage, next int64, behind bool) {
+	rb.mu.RLock()
+	defer rb.mu.RUnlock()
+
+	next = cursor
+	if len(rb.entries) == 0 {
+		return nil, next, false
+	}
+	oldest := rb.entries[rb.start].seq
+	if cursor > 0 && cursor < oldest-1 {
+		behind = true
+	}
+	if cursor >= rb.nextSeq {
+		// A cursor from the future can't have come from this server; send the client back to the start
+		behind = true
+		next = oldest - 1
+	}
+
+	for i := 0; i < len(rb.entries) && len(messages) < limit; i++ {
+		entry := rb.entries[(rb.start+i)%len(rb.entries)]
+		if entry.seq <= next {
+			continue
+		}
+		next = entry.seq
+		if filter.wants(entry.message) {
+			messages = append(messages, entry.message.data)
+		}
+	}
+	return messages, next, behind
+}
+
+// RecentResponse is the JSON body returned by /recent
+type RecentResponse struct {
+	Matches    []json.RawMessage `json:"matches"`
+	NextCursor int64             `json:"nextCursor"`
+
+	// Behind is true when matches after the given cursor were already evicted from the buffer
+	Behind bool `json:"behind,omitempty"`
+}
+
+// recentHandler serves GET /recent?since=<cursor>&limit=N&rules=... for clients that poll
+func recentHandler(rb *ReplayBuffer, known map[string]bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rules, err := ruleFilter(r, known)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		query := r.URL.Query()
+
+		var since int64
+		if s := query.Get("since"); s != "" {
+			since, err = strconv.ParseInt(s, 10, 64)
+			if err != nil || since < 0 {
+				http.Error(w, "since must be a cursor returned by a previous request", http.StatusBadRequest)
+				return
+			}
+		}
+		limit := defaultRecentLimit
+		if l := query.Get("limit"); l != "" {
+			limit, err = strconv.Atoi(l)
+			if err != nil || limit <= 0 {
+				http.Error(w, "limit must be a positive integer", http.StatusBadRequest)
+				return
+			}
+			limit = min(limit, maxRecentLimit)
+		}
+
+		messages, next, behind := rb.Since(since, limit, &hubClient{rules: rules})
+		if messages == nil {
+			messages = []json.RawMessage{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(RecentResponse{Matches: messages, NextCursor: next, Behind: behind})
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HandleResolver maps DIDs to handles using a bounded, TTL-based cache. Lookups never block:
+// a cache miss schedules an asynchronous resolution and returns immediately, so enrichment
+// stays off the hot path.
+type HandleResolver struct {
+	client     *http.Client
+	plcURL     string
+	ttl        time.Duration
+	maxEntries int
+
+	mu      sync.Mutex
+	entries map[string]handleEntry
+	pending map[string]bool
+
+	sem chan struct{} // Bounds concurrent resolutions
+}
+
+type handleEntry struct {
+	handle  string
+	expires time.Time
+}
+
+// didDocument is the subset of a DID document needed to find the handle
+type didDocument struct {
+	AlsoKnownAs []string `json:"alsoKnownAs"`
+}
+
+func NewHandleResolver(plcURL string, ttl time.Duration, maxEntries, concurrency int) *HandleResolver {
+	return &HandleResolver{
+		client:     &http.Client{Timeout: 10 * time.Second},
+		plcURL:     strings.TrimSuffix(plcURL, "/"),
+		ttl:        ttl,
+		maxEntries: maxEntries,
+		entries:    make(map[string]handleEntry),
+		pending:    make(map[string]bool),
+		sem:        make(chan struct{}, concurrency),
+	}
+}
+
+// Lookup returns the cached handle for a DID. On a miss it schedules a background
+// resolution (unless the resolver is already at its concurrency limit) and returns false.
+func (r *HandleResolver) Lookup(did string) (string, bool) {
+	if did == "" {
+		return "", false
+	}
+
+	r.mu.Lock()
+	entry, ok := r.entries[did]
+	if ok && time.Now().Before(entry.expires) {
+		r.mu.Unlock()
+		return entry.handle, entry.handle != ""
+	}
+	if r.pending[did] {
+		r.mu.Unlock()
+		return "", false
+	}
+
+	// Try to claim a resolution slot without blocking
+	select {
+	case r.sem <- struct{}{}:
+	default:
+		r.mu.Unlock()
+		return "", false
+	}
+	r.pending[did] = true
+	r.mu.Unlock()
+
+	go func() {
+		defer func() { <-r.sem }()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		handle, err := r.ResolveDID(ctx, did)
+		if err != nil {
+			slog.Debug("Error resolving handle", "did", did, "error", err)
+		}
+
+		// Failures are cached as empty handles so a broken DID isn't retried on every event
+		r.Store(did, handle)
+
+		r.mu.Lock()
+		delete(r.pending, did)
+		r.mu.Unlock()
+	}()
+
+	return "", false
+}
+
+// Store caches a handle for a DID, evicting entries if the cache is full
+func (r *HandleResolver) Store(did, handle string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, exists := r.entries[did]; !exists && len(r.entries) >= r.maxEntries {
+		r.evictLocked()
+	}
+	r.entries[did] = handleEntry{handle: handle, expires: time.Now().Add(r.ttl)}
+}
+
+// evictLocked removes expired entries, or an arbitrary entry if none have expired.
+// Callers must hold r.mu.
+func (r *HandleResolver) evictLocked() {
+	now := time.Now()
+	evicted := false
+	for did, entry := range r.entries {
+		if now.After(entry.expires) {
+			delete(r.entries, did)
+			evicted = true
+		}
+	}
+	if evicted {
+		return
+	}
+	for did := range r.entries {
+		delete(r.entries, did)
+		return
+	}
+}
+
+// ResolveHandleToDID resolves a handle to its DID via com.atproto.identity.resolveHandle on the given server
+func ResolveHandleToDID(ctx context.Context, server, handle string) (string, error) {
+	handle = strings.TrimPrefix(handle, "@")
+	endpoint := strings.TrimSuffix(server, "/") + "/xrpc/com.atproto.identity.resolveHandle?handle=" + url.QueryEscape(handle)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected status %d resolving handle '%s'", resp.StatusCode, handle)
+	}
+
+	var out struct {
+		Did string `json:"did"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return "", err
+	}
+	if out.Did == "" {
+		return "", fmt.Errorf("no DID returned for handle '%s'", handle)
+	}
+	return out.Did, nil
+}
+
+// ResolveDID fetches the DID document for a did:plc or did:web and returns its handle
+func (r *HandleResolver) ResolveDID(ctx context.Context, did string) (string, error) {
+	var docURL string
+	switch {
+	case strings.HasPrefix(did, "did:plc:"):
+		docURL = r.plcURL + "/" + did
+	case strings.HasPrefix(did, "did:web:"):
+		docURL = "https://" + strings.TrimPrefix(did, "did:web:") + "/.well-known/did.json"
+	default:
+		return "", fmt.Errorf("unsupported DID method: %s", did)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, docURL, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected status %d from %s", resp.StatusCode, docURL)
+	}
+
+	var doc didDocument
+	if err := json.NewDecoder(resp.Body).Decode(&doc); err != nil {
+		return "", err
+	}
+
+	for _, aka := range doc.AlsoKnownAs {
+		if strings.HasPrefix(aka, "at://") {
+			return strings.TrimPrefix(aka, "at://"), nil
+		}
+	}
+	return "", nil
+}
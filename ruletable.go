@@ -0,0 +1,41 @@
+package main
+
+import (
+	"slices"
+	"sync/atomic"
+)
+
+// RuleTable holds compiled rules that can be replaced one at a time while workers match
+// against them. Replacing a rule stores a modified copy of the slice, so the rules a job
+// loaded never change while it is being matched.
+type RuleTable struct {
+	rules atomic.Pointer[[]CompiledRuleSet]
+}
+
+func NewRuleTable(rules []CompiledRuleSet) *RuleTable {
+	t := &RuleTable{}
+	t.rules.Store(&rules)
+	return t
+}
+
+// Load returns the current rules, which callers must not modify
+func (t *RuleTable) Load() []CompiledRuleSet {
+	return *t.rules.Load()
+}
+
+// Store swaps in a new set of rules, such as one built by withRule
+func (t *RuleTable) Store(rules []CompiledRuleSet) {
+	t.rules.Store(&rules)
+}
+
+// withRule returns a copy of rules with rule in place of the rule of the same name, or nil if
+// rules has no rule by that name
+func withRule(rules []CompiledRuleSet, rule CompiledRuleSet) []CompiledRuleSet {
+	i := slices.IndexFunc(rules, func(cr CompiledRuleSet) bool { return cr.Name == rule.Name })
+	if i < 0 {
+		return nil
+	}
+	replaced := slices.Clone(rules)
+	replaced[i] = rule
+	return replaced
+}
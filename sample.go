@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/TheAlyxGreen/firefly"
+)
+
+// sampleTimeout bounds how long -sample listens when some common collections never show up
+const sampleTimeout = time.Minute
+
+// sampleCollections are the common collections -sample waits for before stopping early
+var sampleCollections = []string{
+	"app.bsky.feed.post",
+	"app.bsky.feed.like",
+	"app.bsky.feed.repost",
+	"app.bsky.graph.follow",
+	"app.bsky.graph.block",
+	"app.bsky.actor.profile",
+}
+
+// RunSample subscribes to every collection and prints one event of each collection seen as a
+// single JSON object keyed by collection, in the same form broadcasts carry it. Deletes carry no
+// record, so they're skipped. It stops once every sampleCollections entry has been seen, after
+// sampleTimeout, or when ctx is cancelled.
+func RunSample(ctx context.Context, consumer *JetstreamConsumer) error {
+	ctx, cancel := context.WithTimeout(ctx, sampleTimeout)
+	defer cancel()
+
+	samples := make(map[string]interface{})
+	missing := make(map[string]bool, len(sampleCollections))
+	for _, c := range sampleCollections {
+		missing[c] = true
+	}
+
+	slog.Info("Sampling events", "servers", consumer.servers, "timeout", sampleTimeout)
+	consumer.Run(ctx, func(event *firefly.FirehoseEvent, _ []byte) {
+		info := DescribeEvent(event)
+		if info.Collection == "" || info.Operation == "delete" {
+			return
+		}
+		if _, ok := samples[info.Collection]; ok {
+			return
+		}
+		var payload interface{} = event.RawCommit
+		if event.RawCommit == nil {
+			payload = event
+		}
+		samples[info.Collection] = payload
+		delete(missing, info.Collection)
+		slog.Info("Sampled event", "collection", info.Collection, "remaining", len(missing))
+		if len(missing) == 0 {
+			cancel()
+		}
+	})
+	if len(missing) > 0 {
+		slog.Warn("Stopped before every common collection was seen", "missing", len(missing))
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(samples); err != nil {
+		return fmt.Errorf("failed to write samples: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// Sink is an output destination for matched events: the websocket Hub, a database, a message
+// bus, and so on. Send may block; the SinkDispatcher gives every sink its own goroutine and
+// buffer so a slow sink only delays itself.
+type Sink interface {
+	Send(msg BroadcastMessage)
+}
+
+// FallibleSink is a sink whose deliveries can fail. The dispatcher delivers to it with TrySend,
+// retrying and dead-lettering failures according to the sink's SinkPolicy.
+type FallibleSink interface {
+	TrySend(msg BroadcastMessage) error
+}
+
+// SinkDispatcher fans each match out to every registered sink. Each sink is fed from its own
+// buffered channel by its own goroutine; when a sink's buffer is full the match is dropped for
+// that sink only and counted under the sink's name in GlobalDropStats. Sinks that also
+// implement io.Closer are closed at shutdown, once their queue has drained.
+type SinkDispatcher struct {
+	outputs []*sinkOutput
+
+	mu     sync.RWMutex // Held for reading by Send, so Close can't close a queue mid-send
+	closed bool
+}
+
+type sinkOutput struct {
+	name  string
+	send  func(BroadcastMessage)
+	close func() error // nil for sinks that don't need closing
+	queue chan BroadcastMessage
+	peak  int64         // Most matches ever waiting in queue, updated atomically
+	done  chan struct{} // Closed once the queue has drained and the sink is closed
+}
+
+// SinkQueueStats is how full one sink's buffer is, reported in /stats
+type SinkQueueStats struct {
+	Queued   int   `json:"queued"`   // Matches waiting for the sink now
+	Peak     int64 `json:"peak"`     // Most matches waiting at once since startup
+	Capacity int   `json:"capacity"` // Buffer size; matches beyond it are dropped for this sink
+}
+
+func NewSinkDispatcher() *SinkDispatcher {
+	return &SinkDispatcher{}
+}
+
+// Add registers a sink with its own buffer and starts feeding it. Sinks must all be added
+// before the dispatcher starts receiving matches.
+func (d *SinkDispatcher) Add(name string, sink Sink, bufferSize int) {
+	d.add(name, sink, sink.Send, bufferSize)
+}
+
+// AddFallible registers a sink whose deliveries can fail, like Add, retrying and
+// dead-lettering its failed deliveries according to policy
+func (d *SinkDispatcher) AddFallible(name string, sink FallibleSink, bufferSize int, policy SinkPolicy) {
+	d.add(name, sink, func(msg BroadcastMessage) {
+		policy.Deliver(name, []BroadcastMessage{msg}, func() error { return sink.TrySend(msg) })
+	}, bufferSize)
+}
+
+func (d *SinkDispatcher) add(name string, sink any, send func(BroadcastMessage), bufferSize int) {
+	out := &sinkOutput{
+		name:  name,
+		send:  send,
+		queue: make(chan BroadcastMessage, bufferSize),
+		done:  make(chan struct{}),
+	}
+	if closer, ok := sink.(io.Closer); ok {
+		out.close = closer.Close
+	}
+	d.outputs = append(d.outputs, out)
+
+	go func() {
+		defer close(out.done)
+		for msg := range out.queue {
+			out.send(msg)
+		}
+		if out.close != nil {
+			if err := out.close(); err != nil {
+				slog.Error("Error closing sink", "sink", out.name, "error", err)
+			}
+		}
+	}()
+}
+
+// Close stops accepting matches, then waits until ctx is done for every sink to work through
+// its queue and close. Matches sent after Close are dropped.
+func (d *SinkDispatcher) Close(ctx context.Context) error {
+	d.mu.Lock()
+	if !d.closed {
+		d.closed = true
+		for _, out := range d.outputs {
+			close(out.queue)
+		}
+	}
+	d.mu.Unlock()
+
+	for _, out := range d.outputs {
+		select {
+		case <-out.done:
+		case <-ctx.Done():
+			return fmt.Errorf("sink %s still had %d matches queued: %w", out.name, len(out.queue), ctx.Err())
+		}
+	}
+	return nil
+}
+
+// Send queues the match for every sink without blocking, so a slow sink can never stall the
+// workers or the other sinks
+func (d *SinkDispatcher) Send(msg BroadcastMessage) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if d.closed {
+		return
+	}
+	for _, out := range d.outputs {
+		select {
+		case out.queue <- msg:
+			out.notePeak()
+		default:
+			GlobalDropStats.Increment(out.name)
+		}
+	}
+}
+
+// notePeak raises peak to the current queue length if it's a new high
+func (out *sinkOutput) notePeak() {
+	n := int64(len(out.queue))
+	for {
+		peak := atomic.LoadInt64(&out.peak)
+		if n <= peak || atomic.CompareAndSwapInt64(&out.peak, peak, n) {
+			return
+		}
+	}
+}
+
+// QueueStats reports how full each sink's buffer is, by sink name
+func (d *SinkDispatcher) QueueStats() map[string]SinkQueueStats {
+	stats := make(map[string]SinkQueueStats, len(d.outputs))
+	for _, out := range d.outputs {
+		stats[out.name] = SinkQueueStats{
+			Queued:   len(out.queue),
+			Peak:     atomic.LoadInt64(&out.peak),
+			Capacity: cap(out.queue),
+		}
+	}
+	return stats
+}
+
+// maxSinkBackoff caps the wait between retries of a failed delivery
+const maxSinkBackoff = time.Minute
+
+// SinkPolicy decides what happens when a sink fails to deliver matches. The zero value drops
+// them straight away.
+type SinkPolicy struct {
+	MaxRetries   int             // Retries after the first attempt
+	RetryBackoff time.Duration   // Wait before the first retry, doubling after each one
+	DeadLetter   *DeadLetterFile // Receives matches that fail every attempt; nil drops them
+}
+
+// Deliver calls send until it succeeds or MaxRetries retries have failed, then writes msgs to
+// the dead-letter file, or drops them and counts them under name in GlobalDropStats. Batching
+// sinks pass every match in the batch. Retries block the sink's goroutine, so a failing sink
+// falls behind and sheds matches from its own buffer without holding up the others.
+func (p SinkPolicy) Deliver(name string, msgs []BroadcastMessage, send func() error) {
+	err := send()
+	backoff := p.RetryBackoff
+	for retry := 0; err != nil && retry < p.MaxRetries; retry++ {
+		time.Sleep(backoff)
+		backoff = min(backoff*2, maxSinkBackoff)
+		err = send()
+	}
+	if err == nil {
+		return
+	}
+
+	if p.DeadLetter != nil {
+		dlErr := p.DeadLetter.Write(name, err, msgs)
+		if dlErr == nil {
+			GlobalDeadLetterStats.Add(name, int64(len(msgs)))
+			slog.Warn("Sink delivery failed, dead-lettered", "sink", name, "count", len(msgs), "retries", p.MaxRetries, "error", err)
+			return
+		}
+		slog.Error("Error writing dead letters", "sink", name, "path", p.DeadLetter.path, "error", dlErr)
+	}
+	GlobalDropStats.Add(name, int64(len(msgs)))
+	slog.Warn("Sink delivery failed, dropped", "sink", name, "count", len(msgs), "retries", p.MaxRetries, "error", err)
+}
+
+// DeadLetterFile appends matches that sinks failed to deliver to a file, one JSON object per
+// line, so they can be reprocessed later
+type DeadLetterFile struct {
+	path string
+	mu   sync.Mutex
+	file *os.File
+}
+
+// deadLetter is one line of a dead-letter file
+type deadLetter struct {
+	Sink     string           `json:"sink"`
+	Error    string           `json:"error"`
+	FailedAt time.Time        `json:"failedAt"`
+	Message  BroadcastMessage `json:"message"`
+}
+
+// OpenDeadLetterFile opens path for appending, creating it if needed
+func OpenDeadLetterFile(path string) (*DeadLetterFile, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return &DeadLetterFile{path: path, file: file}, nil
+}
+
+// Write appends one line per message, recording the sink and the error that failed it
+func (d *DeadLetterFile) Write(sink string, cause error, msgs []BroadcastMessage) error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	now := time.Now().UTC()
+	for _, msg := range msgs {
+		if err := enc.Encode(deadLetter{Sink: sink, Error: cause.Error(), FailedAt: now, Message: msg}); err != nil {
+			return err
+		}
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	_, err := d.file.Write(buf.Bytes())
+	return err
+}
+
+// Close closes the file. Nothing may be written after it.
+func (d *DeadLetterFile) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.file.Close()
+}
+
+// RateLimitedSink passes matches on to another sink up to a global rate, dropping the rest and
+// counting them as "rateLimit" in GlobalDropStats
+type RateLimitedSink struct {
+	sink   Sink
+	bucket *TokenBucket
+}
+
+func NewRateLimitedSink(sink Sink, perSecond int) *RateLimitedSink {
+	return &RateLimitedSink{sink: sink, bucket: NewTokenBucket(perSecond)}
+}
+
+func (s *RateLimitedSink) Send(msg BroadcastMessage) {
+	if !s.bucket.Allow(time.Now()) {
+		GlobalDropStats.Increment("rateLimit")
+		return
+	}
+	s.sink.Send(msg)
+}
+
+// NATSSink publishes each match to "<prefix>.<ruleName>" for every rule it matched.
+// While the broker is unreachable the client reconnects in the background and buffers
+// publishes; deliveries only fail once that buffer overflows.
+type NATSSink struct {
+	conn   *nats.Conn
+	prefix string
+}
+
+// NewNATSSink connects to the NATS server. The initial connection is retried in the background,
+// so a broker that is down at startup isn't fatal.
+func NewNATSSink(url, prefix string) (*NATSSink, error) {
+	conn, err := nats.Connect(url,
+		nats.Name("aperture"),
+		nats.RetryOnFailedConnect(true),
+		nats.MaxReconnects(-1),
+		nats.ReconnectWait(2*time.Second),
+		nats.DisconnectErrHandler(func(_ *nats.Conn, err error) {
+			slog.Warn("NATS disconnected", "error", err)
+		}),
+		nats.ReconnectHandler(func(c *nats.Conn) {
+			slog.Info("NATS reconnected", "url", c.ConnectedUrl())
+		}),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &NATSSink{
+		conn:   conn,
+		prefix: strings.TrimSuffix(prefix, "."),
+	}, nil
+}
+
+// TrySend publishes the match once per matched rule. A retry publishes to every subject
+// again, so subjects that succeeded before the failure see the match twice.
+func (s *NATSSink) TrySend(msg BroadcastMessage) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		slog.Error("Error marshaling NATS message", "error", err)
+		return nil // Retrying can't fix it
+	}
+	for _, rule := range msg.MatchedRules {
+		subject := s.prefix + "." + natsSubjectToken(rule)
+		if err := s.conn.Publish(subject, data); err != nil {
+			// Publish only fails once the client's reconnect buffer is exhausted
+			return fmt.Errorf("publishing to %s: %w", subject, err)
+		}
+	}
+	return nil
+}
+
+// Close sends any publishes the client has buffered, then disconnects. Publishes buffered
+// while the broker is unreachable are lost.
+func (s *NATSSink) Close() error {
+	defer s.conn.Close()
+	return s.conn.FlushTimeout(5 * time.Second)
+}
+
+// natsSubjectToken makes a rule name safe to use as a single NATS subject token
+func natsSubjectToken(name string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case '.', '*', '>', ' ', '\t', '\r', '\n':
+			return '_'
+		}
+		return r
+	}, name)
+}
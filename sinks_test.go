@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// blockingSink never returns from Send until released, like a sink whose server hung
+type blockingSink struct {
+	release chan struct{}
+}
+
+func (s *blockingSink) Send(msg BroadcastMessage) {
+	<-s.release
+}
+
+// TestBlockedSinkDoesNotStall checks that a sink that never returns holds up neither the
+// workers calling Send nor delivery to websocket clients, with or without clients connected
+func TestBlockedSinkDoesNotStall(t *testing.T) {
+	hub := NewHub(HubOptions{LegacyFrames: true})
+	go hub.Run()
+
+	slow := &blockingSink{release: make(chan struct{})}
+	output := NewSinkDispatcher()
+	output.Add("websocket", hub, 16)
+	output.Add("slow", slow, 4)
+	defer func() {
+		close(slow.release)
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := output.Close(ctx); err != nil {
+			t.Errorf("closing dispatcher: %v", err)
+		}
+		if err := hub.Close(ctx); err != nil {
+			t.Errorf("closing hub: %v", err)
+		}
+	}()
+
+	// With no clients connected, every match must still be taken off the workers' hands
+	dropsBefore := GlobalDropStats.GetCounts()["slow"]
+	sent := make(chan struct{})
+	go func() {
+		defer close(sent)
+		for i := 0; i < 20000; i++ {
+			output.Send(BroadcastMessage{SchemaVersion: SchemaVersion, MatchedRules: []string{"r"}})
+		}
+	}()
+	select {
+	case <-sent:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Send blocked behind a stalled sink")
+	}
+	if GlobalDropStats.GetCounts()["slow"] <= dropsBefore {
+		t.Error("expected matches beyond the stalled sink's buffer to be dropped and counted")
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serveWs(hub, nil, w, r)
+	}))
+	defer srv.Close()
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+
+	// The client registers asynchronously, so keep sending until a match gets through
+	received := make(chan BroadcastMessage, 1)
+	go func() {
+		var msg BroadcastMessage
+		if _, data, err := conn.ReadMessage(); err == nil && json.Unmarshal(data, &msg) == nil {
+			received <- msg
+		}
+		close(received)
+	}()
+	deadline := time.After(5 * time.Second)
+	for {
+		output.Send(BroadcastMessage{SchemaVersion: SchemaVersion, MatchedRules: []string{"live"}})
+		select {
+		case msg, ok := <-received:
+			if !ok {
+				t.Fatal("websocket client didn't receive a match")
+			}
+			if len(msg.MatchedRules) != 1 || msg.MatchedRules[0] != "live" {
+				t.Errorf("got matchedRules %v, want [live]", msg.MatchedRules)
+			}
+			return
+		case <-deadline:
+			t.Fatal("no match reached the websocket client while a sink was stalled")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS matches (
+	id            INTEGER PRIMARY KEY AUTOINCREMENT,
+	did           TEXT NOT NULL,
+	handle        TEXT,
+	collection    TEXT,
+	rkey          TEXT,
+	matched_rules TEXT NOT NULL,
+	text          TEXT,
+	created_at    TEXT,
+	received_at   TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS idx_matches_did ON matches(did);
+CREATE INDEX IF NOT EXISTS idx_matches_collection ON matches(collection);
+`
+
+// SQLiteSink stores matched events in a SQLite database. Rows are batched and written in a
+// single transaction every batchSize rows or flushInterval, whichever comes first, since
+// per-row commits can't keep up at firehose volume. A batch that fails to write is retried
+// and dead-lettered as a whole, according to policy.
+type SQLiteSink struct {
+	db            *sql.DB
+	rows          chan sqliteRow
+	done          chan struct{} // Closed once run has written the last batch
+	batchSize     int
+	flushInterval time.Duration
+	policy        SinkPolicy
+}
+
+type sqliteRow struct {
+	did          string
+	handle       string
+	collection   string
+	rkey         string
+	matchedRules string
+	text         string
+	createdAt    string
+	receivedAt   string
+
+	msg BroadcastMessage // Written to the dead-letter file if the row's batch fails
+}
+
+// NewSQLiteSink opens (or creates) the database at path, ensures the schema exists, and
+// starts the background writer
+func NewSQLiteSink(path string, batchSize int, flushInterval time.Duration, policy SinkPolicy) (*SQLiteSink, error) {
+	db, err := sql.Open("sqlite3", path+"?_journal_mode=WAL&_synchronous=NORMAL")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to create schema: %w", err)
+	}
+
+	s := &SQLiteSink{
+		db:            db,
+		rows:          make(chan sqliteRow, batchSize*2),
+		done:          make(chan struct{}),
+		batchSize:     batchSize,
+		flushInterval: flushInterval,
+		policy:        policy,
+	}
+	go s.run()
+	return s, nil
+}
+
+// Send converts a match into a row and queues it for the next batch
+func (s *SQLiteSink) Send(msg BroadcastMessage) {
+	info := msg.info
+	if info == nil {
+		return // Only matches produced by the worker carry event details
+	}
+
+	// When the event came off the firehose, so time spent queued doesn't skew the column
+	received := msg.received
+	if received.IsZero() {
+		received = time.Now()
+	}
+
+	rules, _ := json.Marshal(msg.MatchedRules)
+	row := sqliteRow{
+		did:          info.AuthorDID,
+		handle:       msg.AuthorHandle,
+		collection:   info.Collection,
+		matchedRules: string(rules),
+		receivedAt:   received.UTC().Format(time.RFC3339Nano),
+		msg:          msg,
+	}
+
+	event := info.Event
+	if event.RawCommit != nil && event.RawCommit.Commit != nil {
+		row.rkey = event.RawCommit.Commit.RKey
+	}
+	if event.Post != nil {
+		if msg.RedactedTextLength == nil {
+			row.text = event.Post.Text
+		}
+		if event.Post.CreatedAt != nil {
+			row.createdAt = event.Post.CreatedAt.UTC().Format(time.RFC3339Nano)
+		}
+	}
+
+	s.rows <- row
+}
+
+// Close writes the rows still waiting for a batch and closes the database. The dispatcher
+// calls it once it has stopped sending, so nothing may be sent after it.
+func (s *SQLiteSink) Close() error {
+	close(s.rows)
+	<-s.done
+	return s.db.Close()
+}
+
+func (s *SQLiteSink) run() {
+	defer close(s.done)
+	ticker := time.NewTicker(s.flushInterval)
+	defer ticker.Stop()
+
+	batch := make([]sqliteRow, 0, s.batchSize)
+	for {
+		select {
+		case row, ok := <-s.rows:
+			if !ok {
+				if len(batch) > 0 {
+					s.write(batch)
+				}
+				return
+			}
+			batch = append(batch, row)
+			if len(batch) >= s.batchSize {
+				s.write(batch)
+				batch = batch[:0]
+			}
+		case <-ticker.C:
+			if len(batch) > 0 {
+				s.write(batch)
+				batch = batch[:0]
+			}
+		}
+	}
+}
+
+// write flushes a batch, retrying or dead-lettering it if the flush fails
+func (s *SQLiteSink) write(batch []sqliteRow) {
+	msgs := make([]BroadcastMessage, len(batch))
+	for i, row := range batch {
+		msgs[i] = row.msg
+	}
+	s.policy.Deliver("sqlite", msgs, func() error { return s.flush(batch) })
+}
+
+// flush writes a batch in a single transaction, so a failed batch leaves nothing behind
+func (s *SQLiteSink) flush(batch []sqliteRow) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("SQLite begin failed: %w", err)
+	}
+
+	stmt, err := tx.Prepare(`INSERT INTO matches (did, handle, collection, rkey, matched_rules, text, created_at, received_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("SQLite prepare failed: %w", err)
+	}
+	defer stmt.Close()
+
+	for _, row := range batch {
+		if _, err := stmt.Exec(row.did, row.handle, row.collection, row.rkey, row.matchedRules, row.text, row.createdAt, row.receivedAt); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("SQLite insert failed: %w", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("SQLite commit failed: %w", err)
+	}
+	slog.Debug("SQLite batch written", "count", len(batch))
+	return nil
+}
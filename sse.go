@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// sseKeepAlive is how often an idle SSE stream gets a comment line, so proxies and load
+// balancers with idle timeouts don't cut it off between matches
+const sseKeepAlive = 30 * time.Second
+
+// serveSSE streams matches as Server-Sent Events for clients that can't speak websockets.
+// Each match is one "data:" event holding the same JSON as a websocket frame, so ?batch=1
+// and ?rules= work the same way here. The stream ends when the client disconnects.
+func serveSSE(hub *Hub, known map[string]bool, w http.ResponseWriter, r *http.Request) {
+	rules, err := ruleFilter(r, known)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !hub.AcquireSlot() {
+		w.Header().Set("Retry-After", "30")
+		http.Error(w, "too many streaming clients", http.StatusServiceUnavailable)
+		slog.Warn("Rejected SSE client, at capacity", "clients", hub.ClientCount())
+		return
+	}
+
+	client := &hubClient{
+		batched: r.URL.Query().Get("batch") == "1",
+		rules:   rules,
+		send:    make(chan []byte, clientSendBuffer),
+	}
+	hub.register <- client
+	defer func() { hub.unregister <- client }()
+
+	// Reverse proxies often buffer responses, which holds events back until the buffer fills
+	// and makes the stream look dead. X-Accel-Buffering disables this in nginx; other proxies
+	// need response buffering turned off for this path (and compression, which buffers too).
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	rc := http.NewResponseController(w)
+	if err := rc.Flush(); err != nil {
+		slog.Warn("SSE streaming unsupported", "error", err)
+		return
+	}
+
+	keepAlive := time.NewTicker(sseKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		var payload string
+		select {
+		case <-r.Context().Done():
+			return
+		case frame, ok := <-client.send:
+			if !ok {
+				if client.closeReason != "" {
+					fmt.Fprintf(w, "event: close\ndata: %s\n\n", client.closeReason)
+					rc.Flush()
+				}
+				return
+			}
+			// Encoded JSON never contains a raw newline, so each frame fits on one data line
+			payload = fmt.Sprintf("data: %s\n\n", frame)
+		case <-keepAlive.C:
+			if hub.envelope {
+				payload = fmt.Sprintf("data: %s\n\n", heartbeatFrame())
+			} else {
+				payload = ": keep-alive\n\n"
+			}
+		}
+
+		rc.SetWriteDeadline(time.Now().Add(writeWait))
+		if _, err := fmt.Fprint(w, payload); err != nil {
+			return
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
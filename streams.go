@@ -0,0 +1,160 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+)
+
+// firehoseStream is one Jetstream connection and the rules its events are matched against.
+// Rules without their own cursorOffset share the main stream; each distinct rule-level
+// cursorOffset gets a dedicated stream, so one connection can replay history while another
+// stays at the live tip. Events are only matched against the rules of the stream they arrived
+// on, so a rule never sees an event twice.
+type firehoseStream struct {
+	name         string
+	rules        *RuleTable
+	cursorOffset int64 // Microseconds to look back at startup; 0 starts at the live tip
+	dedicated    bool  // Opened for rules with their own cursorOffset
+	consumer     *JetstreamConsumer
+}
+
+// partitionStreams groups rules into streams by cursorOffset. The main stream, using
+// defaultOffset, comes first and is left out when every rule has its own offset. Rules in a
+// group are matched together, so they must all share one offset.
+func partitionStreams(rules []CompiledRuleSet, defaultOffset int64) ([]*firehoseStream, error) {
+	groupOffsets := make(map[string]*int64)
+	for _, rule := range rules {
+		if rule.Group == "" {
+			continue
+		}
+		offset, seen := groupOffsets[rule.Group]
+		if seen && !equalOffsets(offset, rule.CursorOffset) {
+			return nil, fmt.Errorf("rules in group %q must all have the same cursorOffset", rule.Group)
+		}
+		groupOffsets[rule.Group] = rule.CursorOffset
+	}
+
+	shared := &firehoseStream{name: "main", cursorOffset: defaultOffset}
+	byOffset := make(map[int64]*firehoseStream)
+	var dedicated []*firehoseStream
+	members := make(map[*firehoseStream][]CompiledRuleSet)
+	for _, rule := range rules {
+		if rule.CursorOffset == nil {
+			members[shared] = append(members[shared], rule)
+			continue
+		}
+		stream, ok := byOffset[*rule.CursorOffset]
+		if !ok {
+			stream = &firehoseStream{
+				name:         fmt.Sprintf("cursorOffset=%d", *rule.CursorOffset),
+				cursorOffset: *rule.CursorOffset,
+				dedicated:    true,
+			}
+			byOffset[*rule.CursorOffset] = stream
+			dedicated = append(dedicated, stream)
+		}
+		members[stream] = append(members[stream], rule)
+	}
+	shared.rules = NewRuleTable(members[shared])
+	for _, stream := range dedicated {
+		stream.rules = NewRuleTable(members[stream])
+	}
+	slices.SortFunc(dedicated, func(a, b *firehoseStream) int {
+		return cmp.Compare(b.cursorOffset, a.cursorOffset)
+	})
+
+	// Every stream needs rules; a main stream without any would subscribe to the whole firehose
+	if len(members[shared]) == 0 && len(dedicated) > 0 {
+		return dedicated, nil
+	}
+	return append([]*firehoseStream{shared}, dedicated...), nil
+}
+
+func equalOffsets(a, b *int64) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+// ruleNames returns the names of the stream's rules
+func (s *firehoseStream) ruleNames() []string {
+	rules := s.rules.Load()
+	names := make([]string, len(rules))
+	for i, rule := range rules {
+		names[i] = rule.Name
+	}
+	return names
+}
+
+// streamSubscriptions describes the first stream's subscription for /subscription, with any
+// further streams nested under it
+func streamSubscriptions(streams []*firehoseStream) SubscriptionInfo {
+	var info SubscriptionInfo
+	for i, stream := range streams {
+		sub := stream.consumer.Subscription()
+		if stream.dedicated {
+			offset := stream.cursorOffset
+			sub.CursorOffset = &offset
+			sub.Rules = stream.ruleNames()
+		}
+		if i == 0 {
+			info = sub
+			continue
+		}
+		info.Streams = append(info.Streams, sub)
+	}
+	return info
+}
+
+// LoadCursors reads the cursors saved by SaveCursors, keyed by stream name. A missing file
+// is not an error and loads none.
+func LoadCursors(path string) (map[string]int64, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var cursors map[string]int64
+	if err := json.Unmarshal(data, &cursors); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	return cursors, nil
+}
+
+// SaveCursors writes each stream's cursor, the time_us of the last event it received, to
+// path as a JSON object keyed by stream name. Streams that haven't received an event are left
+// out. Like ReplayBuffer.Save, it renames a temporary file over path.
+func SaveCursors(path string, streams []*firehoseStream) error {
+	cursors := make(map[string]int64, len(streams))
+	for _, stream := range streams {
+		if cursor := stream.consumer.cursor.Load(); cursor != 0 {
+			cursors[stream.name] = cursor
+		}
+	}
+	data, err := json.Marshal(cursors)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // Fails harmlessly once renamed
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SubjectCache maps post AT-URIs to the text of the post, fetched with
+// com.atproto.repo.getRecord, so rules can match the post a repost or quote points at. Like
+// ProfileCache, lookups never block: a miss schedules a background fetch and reports the text
+// as unknown.
+type SubjectCache struct {
+	client     *http.Client
+	server     string
+	ttl        time.Duration
+	maxEntries int
+	normalizer TextNormalizer // Applied once per fetch, so subjects match like post text
+
+	mu      sync.Mutex
+	entries map[string]subjectEntry
+	pending map[string]bool
+
+	sem chan struct{} // Bounds concurrent fetches
+}
+
+type subjectEntry struct {
+	text    string // Empty if the fetch failed, e.g. because the post was deleted
+	expires time.Time
+}
+
+func NewSubjectCache(server string, ttl time.Duration, maxEntries, concurrency int, normalizer TextNormalizer) *SubjectCache {
+	return &SubjectCache{
+		client:     &http.Client{Timeout: 10 * time.Second},
+		server:     strings.TrimSuffix(server, "/"),
+		ttl:        ttl,
+		maxEntries: maxEntries,
+		normalizer: normalizer,
+		entries:    make(map[string]subjectEntry),
+		pending:    make(map[string]bool),
+		sem:        make(chan struct{}, concurrency),
+	}
+}
+
+// Lookup returns the cached text of the post at uri. On a miss it schedules a background
+// fetch (unless the cache is already at its concurrency limit) and returns false.
+func (c *SubjectCache) Lookup(uri string) (string, bool) {
+	if uri == "" {
+		return "", false
+	}
+
+	c.mu.Lock()
+	entry, ok := c.entries[uri]
+	if ok && time.Now().Before(entry.expires) {
+		c.mu.Unlock()
+		return entry.text, true
+	}
+	if c.pending[uri] {
+		c.mu.Unlock()
+		return "", false
+	}
+
+	// Try to claim a fetch slot without blocking
+	select {
+	case c.sem <- struct{}{}:
+	default:
+		c.mu.Unlock()
+		return "", false
+	}
+	c.pending[uri] = true
+	c.mu.Unlock()
+
+	go func() {
+		defer func() { <-c.sem }()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		text, err := c.Fetch(ctx, uri)
+		if err != nil {
+			slog.Debug("Error fetching subject post", "uri", uri, "error", err)
+		}
+
+		// Failures are cached as empty text so a deleted post isn't retried on every repost
+		c.store(uri, c.normalizer.Apply(text))
+
+		c.mu.Lock()
+		delete(c.pending, uri)
+		c.mu.Unlock()
+	}()
+
+	return "", false
+}
+
+// store caches a post's text, evicting entries if the cache is full
+func (c *SubjectCache) store(uri, text string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, exists := c.entries[uri]; !exists && len(c.entries) >= c.maxEntries {
+		c.evictLocked()
+	}
+	c.entries[uri] = subjectEntry{text: text, expires: time.Now().Add(c.ttl)}
+}
+
+// evictLocked removes expired entries, or an arbitrary entry if none have expired.
+// Callers must hold c.mu.
+func (c *SubjectCache) evictLocked() {
+	now := time.Now()
+	evicted := false
+	for uri, entry := range c.entries {
+		if now.After(entry.expires) {
+			delete(c.entries, uri)
+			evicted = true
+		}
+	}
+	if evicted {
+		return
+	}
+	for uri := range c.entries {
+		delete(c.entries, uri)
+		return
+	}
+}
+
+// Fetch retrieves a post's text with com.atproto.repo.getRecord
+func (c *SubjectCache) Fetch(ctx context.Context, uri string) (string, error) {
+	parts := strings.SplitN(strings.TrimPrefix(uri, "at://"), "/", 3)
+	if len(parts) != 3 {
+		return "", fmt.Errorf("malformed AT-URI %q", uri)
+	}
+	query := url.Values{"repo": {parts[0]}, "collection": {parts[1]}, "rkey": {parts[2]}}
+	endpoint := c.server + "/xrpc/com.atproto.repo.getRecord?" + query.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected status %d fetching record %s", resp.StatusCode, uri)
+	}
+
+	var out struct {
+		Value struct {
+			Text string `json:"text"`
+		} `json:"value"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return "", err
+	}
+	return out.Value.Text, nil
+}
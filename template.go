@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// OutputTemplateData is what a rule's outputTemplate is executed with
+type OutputTemplateData struct {
+	DID          string
+	Handle       string // Empty unless known from the event or resolveHandles
+	Collection   string
+	Operation    string
+	Text         string    // Post text; empty for other records
+	CreatedAt    time.Time // Post creation time; zero for other records
+	URI          string    // AT-URI of the record; empty for identity and account events
+	URL          string    // bsky.app link for posts, otherwise the AT-URI
+	MatchedRules []string
+}
+
+// CompileOutputTemplate parses a rule's outputTemplate and executes it once against sample
+// data, so references to fields that don't exist fail at load time rather than on a match
+func CompileOutputTemplate(name, text string) (*template.Template, error) {
+	tmpl, err := template.New(name).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	sample := OutputTemplateData{
+		DID:          "did:plc:example",
+		Handle:       "example.bsky.social",
+		Collection:   "app.bsky.feed.post",
+		Operation:    "create",
+		Text:         "Example post",
+		CreatedAt:    time.Now(),
+		URI:          "at://did:plc:example/app.bsky.feed.post/example",
+		URL:          "https://bsky.app/profile/did:plc:example/post/example",
+		MatchedRules: []string{name},
+	}
+	if err := tmpl.Execute(new(strings.Builder), sample); err != nil {
+		return nil, err
+	}
+	return tmpl, nil
+}
+
+// newOutputTemplateData collects the template fields for a match
+func newOutputTemplateData(msg BroadcastMessage) OutputTemplateData {
+	info := msg.info
+	data := OutputTemplateData{
+		DID:          info.AuthorDID,
+		Handle:       msg.AuthorHandle,
+		Collection:   info.Collection,
+		Operation:    info.Operation,
+		MatchedRules: msg.MatchedRules,
+	}
+	event := info.Event
+	if event.Post != nil && msg.RedactedTextLength == nil {
+		data.Text = event.Post.Text
+		if event.Post.CreatedAt != nil {
+			data.CreatedAt = *event.Post.CreatedAt
+		}
+	}
+	data.URI = msg.AtURI
+	data.URL = data.URI
+	if event.RawCommit != nil && event.RawCommit.Commit != nil && event.RawCommit.Commit.Collection == "app.bsky.feed.post" {
+		data.URL = fmt.Sprintf("https://bsky.app/profile/%s/post/%s", event.Repo, event.RawCommit.Commit.RKey)
+	}
+	return data
+}
+
+// renderOutputTemplates renders the outputTemplate of each matched rule that has one, keyed by
+// rule name. A template that fails on this event is logged and left out.
+func renderOutputTemplates(rules []*CompiledRuleSet, msg BroadcastMessage) map[string]string {
+	var rendered map[string]string
+	var data *OutputTemplateData
+	for _, rule := range rules {
+		if rule.OutputTemplate == nil {
+			continue
+		}
+		if data == nil {
+			d := newOutputTemplateData(msg)
+			data = &d
+		}
+		var out strings.Builder
+		if err := rule.OutputTemplate.Execute(&out, data); err != nil {
+			slog.Warn("Error rendering output template", "rule", rule.Name, "error", err)
+			continue
+		}
+		if rendered == nil {
+			rendered = make(map[string]string)
+		}
+		rendered[rule.Name] = out.String()
+	}
+	return rendered
+}
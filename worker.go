@@ -2,41 +2,350 @@ package main
 
 import (
 	"encoding/json"
-	"log"
+	"fmt"
+	"hash/fnv"
+	"log/slog"
+	"math/rand/v2"
 	"regexp"
+	"slices"
 	"sync"
 	"sync/atomic"
+	"text/template"
+	"time"
 
 	"github.com/TheAlyxGreen/firefly"
 )
 
 type CompiledRuleSet struct {
-	Name         string
-	Collections  []string
-	TextPatterns []*regexp.Regexp
-	UrlPatterns  []*regexp.Regexp
-	Authors      map[string]bool
-	TargetUsers  map[string]bool
-	EmbedTypes   []string
-	Langs        []string
-	IsReply      *bool
+	Name           string
+	Group          string // Rules sharing a group must all match (see MatchRules)
+	Priority       int    // Rules are sorted by descending priority at startup
+	StopOnMatch    bool   // Skip the remaining rules after this one matches
+	Collections    []string
+	Operations     []string
+	TextPatterns   []*regexp.Regexp
+	TextPrefilters []string       // Literal each text pattern requires, parallel to TextPatterns; "" means none
+	CombinedText   *regexp.Regexp // All TextPatterns as one alternation; nil when they can't be combined
+	CaptureGroups  bool           // Report the matching text pattern's named groups, skipping CombinedText
+	UrlPatterns    []*regexp.Regexp
+
+	ExternalTitlePatterns []*regexp.Regexp
+	ExternalDescPatterns  []*regexp.Regexp
+	SubjectTextPatterns   []*regexp.Regexp
+	AltTextPatterns       []*regexp.Regexp
+
+	Authors           DIDList
+	TargetUsers       DIDList
+	TargetInvolved    DIDList
+	QuoteTargets      DIDList
+	TargetCollections []string
+	AccountStatuses   []string
+	IdentityChanges   bool
+	EmbedTypes        []string
+	HasEmbed          *bool
+	MinMentions       *int
+	MaxMentions       *int
+	MinLinks          *int
+	MaxLinks          *int
+	MaxVideoSeconds   *int
+	VideoAspect       string
+	AltTextSource     string
+	Langs             []string
+	IsReply           *bool
+	MinReplyDepth     *int
+	SelfReplyOnly     *bool
+	HasThreadgate     *bool
+	ThreadgateType    string
+	MinFollowers      *int
+	MinAccountAge     *time.Duration
+	TimeWindow        *TimeWindow
+	MaxClockSkew      *time.Duration
+	MaxBackdate       *time.Duration
+	MaxAge            *time.Duration
+	AllowUndated      bool            // Whether posts without a usable createdAt pass MaxAge
+	CustomMatchers    []MatcherFunc   // Registered Go matchers (see RegisterMatcher)
+	CustomMatchAny    bool            // Any custom matcher passing is enough, rather than all of them
+	CursorOffset      *int64          // Set when the rule has its own stream (see firehoseStream)
+	SampleRate        float64         // Fraction of matches emitted; 0 or 1 emits all
+	SampleConsistent  bool            // Sample by author rather than per match
+	Cooldown          *AuthorCooldown // Set when the rule has an authorCooldownSeconds
+	Weight            float64         // Added to the broadcast's score when the rule matches
+	OutputTemplate    *template.Template
+	RedactText        bool // Strip post content from broadcasts of this rule's matches
+	Tags              []string
+	StaleAfter        time.Duration // Quiet period before a stale warning is logged; 0 disables
 }
 
+// GlobalFilter holds checks applied once per event before any rule is evaluated
+type GlobalFilter struct {
+	BlockedAuthors     map[string]bool
+	AllowedAuthors     map[string]bool // Empty means all authors are allowed
+	IgnoredCollections map[string]bool
+}
+
+// NewGlobalFilter builds a GlobalFilter from the configured block and allow lists and ignored collections
+func NewGlobalFilter(blockDIDs, allowDIDs, ignoreCollections []string) *GlobalFilter {
+	gf := &GlobalFilter{
+		BlockedAuthors:     make(map[string]bool),
+		AllowedAuthors:     make(map[string]bool),
+		IgnoredCollections: make(map[string]bool),
+	}
+	for _, collection := range ignoreCollections {
+		gf.IgnoredCollections[collection] = true
+	}
+	for _, did := range blockDIDs {
+		gf.BlockedAuthors[did] = true
+	}
+	for _, did := range allowDIDs {
+		gf.AllowedAuthors[did] = true
+	}
+	return gf
+}
+
+// Permits reports whether an event should proceed to rule evaluation. Ignored collections are
+// dropped first; then global block beats global allow, which beats per-rule matching.
+func (gf *GlobalFilter) Permits(info *EventInfo) bool {
+	if gf.IgnoredCollections[info.Collection] {
+		return false
+	}
+	authorDID := info.AuthorDID
+	if gf.BlockedAuthors[authorDID] {
+		return false
+	}
+	if len(gf.AllowedAuthors) > 0 && !gf.AllowedAuthors[authorDID] {
+		return false
+	}
+	return true
+}
+
+// authorHandle returns the author's handle from the event if present, otherwise from the resolver
+// cache. Unresolved DIDs return an empty string and are resolved in the background.
+func authorHandle(event *firefly.FirehoseEvent, resolver *HandleResolver) string {
+	if event.Post != nil && event.Post.Author != nil && event.Post.Author.Handle != "" {
+		return event.Post.Author.Handle
+	}
+	if event.IdentityEvent != nil && event.IdentityEvent.Handle != "" {
+		return event.IdentityEvent.Handle
+	}
+	if resolver == nil {
+		return ""
+	}
+	handle, _ := resolver.Lookup(event.Repo)
+	return handle
+}
+
+// recordURI returns the AT-URI of a commit event's record, or "" for other events
+func recordURI(event *firefly.FirehoseEvent) string {
+	if event.RawCommit == nil || event.RawCommit.Commit == nil {
+		return ""
+	}
+	commit := event.RawCommit.Commit
+	return fmt.Sprintf("at://%s/%s/%s", event.RawCommit.Did, commit.Collection, commit.RKey)
+}
+
+// Info returns the client-facing metadata for the rule
+func (cr CompiledRuleSet) Info() RuleInfo {
+	return RuleInfo{
+		Name:        cr.Name,
+		Collections: cr.Collections,
+		Langs:       cr.Langs,
+		EmbedTypes:  cr.EmbedTypes,
+		IsReply:     cr.IsReply,
+		Tags:        cr.Tags,
+		Priority:    cr.Priority,
+		LastMatched: GlobalRuleStats.LastMatched(cr.Name),
+	}
+}
+
+// SchemaVersion identifies the shape of BroadcastMessage. Bump it, and note the change in the
+// README, whenever a field is added, moved, or changes meaning.
+const SchemaVersion = 7
+
 type BroadcastMessage struct {
-	Event        interface{} `json:"event"` // Sending RawCommit (models.Event)
-	MatchedRules []string    `json:"matchedRules"`
+	SchemaVersion int         `json:"schemaVersion"`
+	Event         interface{} `json:"event"` // Sending RawCommit (models.Event)
+	MatchedRules  []string    `json:"matchedRules"`
+	Operation     string      `json:"operation,omitempty"` // create, update, or delete for commit events
+
+	// AtURI is the record's at://did/collection/rkey URI for commit events, the app-agnostic identifier
+	AtURI string `json:"atUri,omitempty"`
+
+	// MatchedGroups lists the rule groups whose rules all matched; their rules are also in MatchedRules
+	MatchedGroups []string `json:"matchedGroups,omitempty"`
+
+	// Identity carries the new handle for identity events
+	Identity *IdentityChange `json:"identity,omitempty"`
+
+	// AuthorAgeHours is the author's account age, when a matched rule's profile checks looked it up
+	AuthorAgeHours *int64 `json:"authorAgeHours,omitempty"`
+
+	// AccountStatus is the account's new status for account events (active, deactivated, takendown, ...)
+	AccountStatus string `json:"accountStatus,omitempty"`
+	AuthorHandle  string `json:"authorHandle,omitempty"`
+	TargetHandle  string `json:"targetHandle,omitempty"`
+
+	// ClockSkewSeconds is createdAt minus server time, set when a matched rule flagged the post as backdated
+	ClockSkewSeconds *int64 `json:"clockSkewSeconds,omitempty"`
+
+	// MatchDetails maps each matched rule to the conditions that triggered it, when matchDetails is enabled
+	MatchDetails map[string]*MatchDetail `json:"matchDetails,omitempty"`
+
+	// Rendered maps each matched rule with an outputTemplate to its rendered text
+	Rendered map[string]string `json:"rendered,omitempty"`
+
+	// RedactedTextLength is the length in characters of the text removed by a redactText rule;
+	// set only when the event's content was redacted
+	RedactedTextLength *int `json:"redactedTextLength,omitempty"`
+
+	// Truncated is true when the record's text, facets, or images were cut by maxTextBytes or maxListItems
+	Truncated bool `json:"truncated,omitempty"`
+
+	// Tags maps each matched rule that has tags to them
+	Tags map[string][]string `json:"tags,omitempty"`
+
+	// Captures maps each matched captureGroups rule to the named groups its text regex captured
+	Captures map[string]map[string]string `json:"captures,omitempty"`
+
+	// Replay is true for matches made during startupGraceSeconds, typically a cursor replay's backlog
+	Replay bool `json:"replay,omitempty"`
+
+	// Score is the sum of the matched rules' weights, set when scoring is enabled
+	Score *float64 `json:"score,omitempty"`
+
+	// RawFrame is the Jetstream frame the match came from, untouched, when includeRawFrame is enabled
+	RawFrame json.RawMessage `json:"rawFrame,omitempty"`
+
+	info *EventInfo // Source event details for sinks; not serialized
+
+	// When the event came off the firehose and when upstream produced it, for latency stats;
+	// zero when unknown
+	received time.Time
+	produced time.Time
 }
 
-// RuleStats tracks the number of matches for each rule
+// IdentityChange is the DID and its current handle from an identity event
+type IdentityChange struct {
+	DID    string `json:"did"`
+	Handle string `json:"handle,omitempty"` // Empty if the handle no longer resolves
+}
+
+// RuleStats tracks the number of matches and the last match time for each rule
 type RuleStats struct {
-	counts sync.Map // map[string]*int64
+	counts    sync.Map // map[string]*int64
+	lastMatch sync.Map // map[string]*int64 (UnixNano)
+}
+
+// StatsSnapshot is the JSON body returned by /stats
+type StatsSnapshot struct {
+	Counts      map[string]int64     `json:"counts"`
+	LastMatched map[string]time.Time `json:"lastMatched"`
+	Dropped     map[string]int64     `json:"dropped"`
+
+	// CooldownDropped counts each rule's matches dropped by its authorCooldownSeconds
+	CooldownDropped map[string]int64 `json:"cooldownDropped"`
+
+	// DeadLettered counts matches each sink failed to deliver and wrote to its deadLetterFile
+	DeadLettered map[string]int64 `json:"deadLettered"`
+
+	// EventsReceived counts events received from the firehose, matched or not
+	EventsReceived int64 `json:"eventsReceived"`
+
+	// QueueDropped counts firehose events discarded by queueFullPolicy before reaching a worker
+	QueueDropped int64 `json:"queueDropped"`
+
+	// MalformedEvents counts firehose events skipped because they failed to decode, parse, or process
+	MalformedEvents int64 `json:"malformedEvents"`
+
+	// ReplayDropped counts events re-delivered after a reconnect and skipped by dropReplayedBeforeCursor
+	ReplayDropped int64 `json:"replayDropped"`
+
+	// Collections counts events processed per collection, matched or not
+	Collections map[string]int64 `json:"collections"`
+
+	// SinkQueues shows how full each output sink's buffer is, to spot a sink falling behind
+	// before it starts dropping matches
+	SinkQueues map[string]SinkQueueStats `json:"sinkQueues,omitempty"`
+
+	// Latency summarizes how long recent matches took to reach the client hub; omitted before the first
+	Latency *LatencySnapshot `json:"latency,omitempty"`
 }
 
 var GlobalRuleStats = &RuleStats{}
 
+// CounterSet is a concurrency-safe set of named counters
+type CounterSet struct {
+	counts sync.Map // map[string]*int64
+}
+
+// GlobalDropStats counts matches dropped by each output sink
+var GlobalDropStats = &CounterSet{}
+
+// GlobalCooldownStats counts matches dropped by each rule's author cooldown
+var GlobalCooldownStats = &CounterSet{}
+
+// GlobalDeadLetterStats counts matches each sink wrote to its dead-letter file
+var GlobalDeadLetterStats = &CounterSet{}
+
+func (cs *CounterSet) Increment(name string) {
+	cs.Add(name, 1)
+}
+
+func (cs *CounterSet) Add(name string, n int64) {
+	val, _ := cs.counts.LoadOrStore(name, new(int64))
+	atomic.AddInt64(val.(*int64), n)
+}
+
+func (cs *CounterSet) GetCounts() map[string]int64 {
+	result := make(map[string]int64)
+	cs.counts.Range(func(key, value interface{}) bool {
+		result[key.(string)] = atomic.LoadInt64(value.(*int64))
+		return true
+	})
+	return result
+}
+
 func (rs *RuleStats) Increment(ruleName string) {
 	val, _ := rs.counts.LoadOrStore(ruleName, new(int64))
 	atomic.AddInt64(val.(*int64), 1)
+
+	last, _ := rs.lastMatch.LoadOrStore(ruleName, new(int64))
+	atomic.StoreInt64(last.(*int64), time.Now().UnixNano())
+}
+
+// LastMatched returns the time the rule last matched, or nil if it never has
+func (rs *RuleStats) LastMatched(ruleName string) *time.Time {
+	val, ok := rs.lastMatch.Load(ruleName)
+	if !ok {
+		return nil
+	}
+	t := time.Unix(0, atomic.LoadInt64(val.(*int64)))
+	return &t
+}
+
+func (rs *RuleStats) GetLastMatched() map[string]time.Time {
+	result := make(map[string]time.Time)
+	rs.lastMatch.Range(func(key, value interface{}) bool {
+		result[key.(string)] = time.Unix(0, atomic.LoadInt64(value.(*int64)))
+		return true
+	})
+	return result
+}
+
+func (rs *RuleStats) Snapshot() StatsSnapshot {
+	return StatsSnapshot{
+		Counts:      rs.GetCounts(),
+		LastMatched: rs.GetLastMatched(),
+		Dropped:     GlobalDropStats.GetCounts(),
+
+		CooldownDropped: GlobalCooldownStats.GetCounts(),
+		DeadLettered:    GlobalDeadLetterStats.GetCounts(),
+		EventsReceived:  atomic.LoadInt64(&eventsReceived),
+		QueueDropped:    atomic.LoadInt64(&queueDropped),
+		MalformedEvents: atomic.LoadInt64(&malformedEvents),
+		ReplayDropped:   atomic.LoadInt64(&replayDropped),
+		Collections:     CollectionCounts(),
+		Latency:         GlobalLatency.Snapshot(),
+	}
 }
 
 func (rs *RuleStats) GetCounts() map[string]int64 {
@@ -48,235 +357,493 @@ func (rs *RuleStats) GetCounts() map[string]int64 {
 	return result
 }
 
-func StartDispatcher(numWorkers int, jobQueue <-chan *firefly.FirehoseEvent, broadcast chan<- []byte, rules []CompiledRuleSet) {
-	var wg sync.WaitGroup
-	for i := 0; i < numWorkers; i++ {
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-			worker(jobQueue, broadcast, rules)
-		}()
+// WatchStaleRules periodically logs a warning when a rule that has matched before goes quiet
+// for longer than its StaleAfter threshold. Each quiet period is only reported once.
+func WatchStaleRules(rules *RuleTable, interval time.Duration) {
+	warned := make(map[string]time.Time)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		for _, rule := range rules.Load() {
+			if rule.StaleAfter <= 0 {
+				continue
+			}
+			last := GlobalRuleStats.LastMatched(rule.Name)
+			if last == nil {
+				continue // Never matched, so it was never active
+			}
+			if time.Since(*last) < rule.StaleAfter {
+				continue
+			}
+			if warned[rule.Name].Equal(*last) {
+				continue
+			}
+			warned[rule.Name] = *last
+			slog.Warn("Rule has gone quiet", "rule", rule.Name, "lastMatched", last.Format(time.RFC3339), "quietFor", time.Since(*last).Round(time.Second))
+		}
 	}
-	wg.Wait()
 }
 
-func worker(jobs <-chan *firefly.FirehoseEvent, broadcast chan<- []byte, rules []CompiledRuleSet) {
-	for event := range jobs {
-		// Determine the collection of the event
-		var collection string
-		var authorDID string
-		var targetUserDID string
-
-		// 1. Determine Author
-		authorDID = event.Repo
-
-		// 2. Determine Collection
-		switch event.Type {
-		case firefly.EventTypePost:
-			collection = "app.bsky.feed.post"
-		case firefly.EventTypeLike:
-			collection = "app.bsky.feed.like"
-		case firefly.EventTypeRepost:
-			collection = "app.bsky.feed.repost"
-		case firefly.EventTypeDelete:
-			if event.DeleteEvent != nil {
-				collection = event.DeleteEvent.Collection
-			}
-		case firefly.EventTypeIdentity:
-			collection = "identity"
-		case firefly.EventTypeAccount:
-			collection = "account"
+// Job is a firehose event waiting for a worker, with the rules of the stream it arrived on
+type Job struct {
+	Event    *firefly.FirehoseEvent
+	Rules    []CompiledRuleSet
+	Received time.Time // When the event came off the firehose, for latency stats
+	RawFrame []byte    // The frame's JSON, kept only when includeRawFrame is enabled
+}
+
+// WorkerOptions holds everything a worker needs to evaluate and enrich events
+type WorkerOptions struct {
+	Filter   *GlobalFilter
+	Resolver *HandleResolver
+	Profiles *ProfileCache // Set when any rule needs author profiles
+	Subjects *SubjectCache // Set when any rule matches reposted or quoted posts' text
+	Output   Sink          // Receives every match, usually a SinkDispatcher
+
+	// MatchDetails records which conditions triggered each match in the broadcast
+	MatchDetails bool
+
+	// Scoring adds each broadcast's score; events scoring below MinScore aren't broadcast
+	Scoring  bool
+	MinScore float64
+
+	// DebugSampleRate is the fraction of events (0.0-1.0) whose rule non-matches are logged at debug level
+	DebugSampleRate float64
+
+	// Normalizer transforms post text before matching; nil matches the original text
+	Normalizer TextNormalizer
+
+	// Limits on the record copied into broadcasts; 0 disables them
+	MaxTextBytes int
+	MaxListItems int
+
+	// ReplayUntil is the end of the startup grace period; matches before it are marked as replayed
+	ReplayUntil time.Time
+}
+
+// Policies for a full job queue
+const (
+	QueueFullBlock      = "block"      // Wait for a worker, stalling the firehose consumer
+	QueueFullDropNewest = "dropNewest" // Discard the incoming event
+	QueueFullDropOldest = "dropOldest" // Discard the longest-waiting event to make room
+)
+
+var queueDropped int64
+
+// malformedEvents counts events skipped because they couldn't be parsed or processed
+var malformedEvents int64
+
+// RecordMalformedEvent counts an event that was skipped because it was malformed
+func RecordMalformedEvent() {
+	atomic.AddInt64(&malformedEvents, 1)
+}
+
+// countedCollections are the collections /stats counts individually. Everything else is
+// counted as "other", so the firehose can't grow the map with arbitrary lexicons.
+var countedCollections = []string{
+	"app.bsky.feed.post",
+	"app.bsky.feed.like",
+	"app.bsky.feed.repost",
+	"app.bsky.feed.threadgate",
+	"app.bsky.feed.postgate",
+	"app.bsky.feed.generator",
+	"app.bsky.graph.follow",
+	"app.bsky.graph.block",
+	"app.bsky.graph.list",
+	"app.bsky.graph.listitem",
+	"app.bsky.graph.starterpack",
+	"app.bsky.actor.profile",
+	"identity",
+	"account",
+}
+
+// collectionSlots maps each counted collection to its counter in collectionCounts
+var collectionSlots = func() map[string]int {
+	slots := make(map[string]int, len(countedCollections))
+	for i, collection := range countedCollections {
+		slots[collection] = i
+	}
+	return slots
+}()
+
+// collectionCounts counts events per countedCollections entry, with "other" last
+var collectionCounts = make([]int64, len(countedCollections)+1)
+
+// RecordCollection counts an event of the given collection
+func RecordCollection(collection string) {
+	slot, ok := collectionSlots[collection]
+	if !ok {
+		slot = len(countedCollections)
+	}
+	atomic.AddInt64(&collectionCounts[slot], 1)
+}
+
+// CollectionCounts returns the events processed per collection, leaving out those with none
+func CollectionCounts() map[string]int64 {
+	counts := make(map[string]int64)
+	for slot := range collectionCounts {
+		n := atomic.LoadInt64(&collectionCounts[slot])
+		if n == 0 {
+			continue
 		}
+		name := "other"
+		if slot < len(countedCollections) {
+			name = countedCollections[slot]
+		}
+		counts[name] = n
+	}
+	return counts
+}
+
+// replayDropped counts events skipped because a reconnect re-delivered them
+var replayDropped int64
 
-		// 3. Determine Target User
-		getDID := func(uri string) string {
-			did, err := firefly.ExtractDidFromUri(uri)
-			if err != nil && err != firefly.ErrNoDid {
-				return ""
+// RecordReplayDropped counts an event skipped because it was handled before a reconnect
+func RecordReplayDropped() {
+	atomic.AddInt64(&replayDropped, 1)
+}
+
+// EnqueueEvent hands an event to the workers, applying policy when the queue is full
+func EnqueueEvent(queue chan Job, job Job, policy string) {
+	switch policy {
+	case QueueFullDropNewest:
+		select {
+		case queue <- job:
+		default:
+			atomic.AddInt64(&queueDropped, 1)
+		}
+	case QueueFullDropOldest:
+		for {
+			select {
+			case queue <- job:
+				return
+			default:
+			}
+			// Workers may drain the queue between the two selects, so only count what we remove
+			select {
+			case <-queue:
+				atomic.AddInt64(&queueDropped, 1)
+			default:
 			}
-			return did
 		}
+	default:
+		queue <- job
+	}
+}
 
-		if event.LikeEvent != nil && event.LikeEvent.Subject != nil {
-			targetUserDID = getDID(event.LikeEvent.Subject.URI)
-		} else if event.RepostEvent != nil && event.RepostEvent.Subject != nil {
-			targetUserDID = getDID(event.RepostEvent.Subject.URI)
-		} else if event.Post != nil && event.Post.ReplyInfo != nil {
-			targetUserDID = getDID(event.Post.ReplyInfo.ReplyTarget.URI)
-		}
+// Sampling modes for rules with a sampleRate
+const (
+	SampleRandom     = "random"     // Each match is kept with probability sampleRate
+	SampleConsistent = "consistent" // The same fraction of authors is always kept
+)
 
-		var matchedRules []string
-
-		for _, rule := range rules {
-			// 1. Check Collection
-			if len(rule.Collections) > 0 {
-				// Check for wildcard
-				wildcard := false
-				for _, c := range rule.Collections {
-					if c == "*" {
-						wildcard = true
-						break
-					}
-				}
+// sampledOut reports whether a match should be dropped by the rule's sampleRate
+func (cr *CompiledRuleSet) sampledOut(authorDID string, rng *rand.Rand) bool {
+	if cr.SampleRate <= 0 || cr.SampleRate >= 1 {
+		return false
+	}
+	if cr.SampleConsistent {
+		return authorSamplePoint(authorDID) >= cr.SampleRate
+	}
+	return rng.Float64() >= cr.SampleRate
+}
 
-				if !wildcard {
-					collectionMatch := false
-					for _, c := range rule.Collections {
-						if c == collection {
-							collectionMatch = true
-							break
-						}
-					}
-					if !collectionMatch {
-						continue
-					}
-				}
-			}
+// authorSamplePoint maps a DID to a fixed point in [0, 1): the top 53 bits of the 64-bit
+// FNV-1a hash of the DID, divided by 2^53. It depends only on the DID, so consistent sampling
+// keeps the same authors across restarts and versions, and raising a rule's sampleRate only
+// ever adds authors. Don't change it without treating it as a breaking change.
+func authorSamplePoint(did string) float64 {
+	h := fnv.New64a()
+	h.Write([]byte(did))
+	return float64(h.Sum64()>>11) / (1 << 53)
+}
 
-			// 2. Check Author (Exact Match)
-			if len(rule.Authors) > 0 {
-				if !rule.Authors[authorDID] {
-					continue
-				}
+// applySampling drops matches from sampled rules that lose their roll. A grouped rule that is
+// sampled out drops its whole group, so a group is emitted at most as often as its lowest rate.
+func applySampling(matches []RuleMatch, groups []string, authorDID string, rng *rand.Rand) ([]RuleMatch, []string) {
+	var droppedGroups map[string]bool
+	kept := matches[:0]
+	for _, m := range matches {
+		if !m.Rule.sampledOut(authorDID, rng) {
+			kept = append(kept, m)
+			continue
+		}
+		if m.Rule.Group != "" {
+			if droppedGroups == nil {
+				droppedGroups = make(map[string]bool)
 			}
+			droppedGroups[m.Rule.Group] = true
+		}
+	}
+	if droppedGroups == nil {
+		return kept, groups
+	}
 
-			// 3. Check Target User (Exact Match)
-			if len(rule.TargetUsers) > 0 {
-				if targetUserDID == "" || !rule.TargetUsers[targetUserDID] {
-					continue
-				}
-			}
+	matches = kept
+	kept = matches[:0]
+	for _, m := range matches {
+		if !droppedGroups[m.Rule.Group] {
+			kept = append(kept, m)
+		}
+	}
+	groups = slices.DeleteFunc(groups, func(group string) bool { return droppedGroups[group] })
+	return kept, groups
+}
 
-			// 4. Check Text Patterns (if any)
-			if len(rule.TextPatterns) > 0 {
-				if event.Post == nil {
-					continue
-				}
+// applyCooldowns drops matches from rules whose author matched them too recently, counting
+// each drop. A grouped rule on cooldown keeps its whole group from matching, so grouped rules
+// are all checked before any of their cooldowns restart.
+func applyCooldowns(matches []RuleMatch, groups []string, authorDID string) ([]RuleMatch, []string) {
+	now := time.Now()
+	var cooledGroups map[string]bool
+	for _, m := range matches {
+		if m.Rule.Group == "" || m.Rule.Cooldown == nil || m.Rule.Cooldown.Ready(authorDID, now) {
+			continue
+		}
+		if cooledGroups == nil {
+			cooledGroups = make(map[string]bool)
+		}
+		cooledGroups[m.Rule.Group] = true
+		GlobalCooldownStats.Increment(m.Rule.Name)
+	}
 
-				textConditionMet := false
-				for _, pattern := range rule.TextPatterns {
-					if pattern.MatchString(event.Post.Text) {
-						textConditionMet = true
-						break
-					}
-				}
-				if !textConditionMet {
-					continue
-				}
-			}
+	kept := matches[:0]
+	for _, m := range matches {
+		if m.Rule.Group != "" && cooledGroups[m.Rule.Group] {
+			continue
+		}
+		if m.Rule.Cooldown != nil && !m.Rule.Cooldown.Allow(authorDID, now) && m.Rule.Group == "" {
+			// Grouped rules were checked above; losing a race with another worker here doesn't undo the group
+			GlobalCooldownStats.Increment(m.Rule.Name)
+			continue
+		}
+		kept = append(kept, m)
+	}
 
-			// 5. Check URL Patterns (if any)
-			if len(rule.UrlPatterns) > 0 {
-				if event.Post == nil {
-					continue
-				}
+	if cooledGroups != nil {
+		groups = slices.DeleteFunc(groups, func(group string) bool { return cooledGroups[group] })
+	}
+	return kept, groups
+}
 
-				urlConditionMet := false
-				if event.Post.Embed != nil && event.Post.Embed.External != nil {
-					url := event.Post.Embed.External.URL
-					for _, pattern := range rule.UrlPatterns {
-						if pattern.MatchString(url) {
-							urlConditionMet = true
-							break
-						}
-					}
-				}
-				if !urlConditionMet {
-					continue
-				}
-			}
+func StartDispatcher(numWorkers int, jobQueue <-chan Job, opts WorkerOptions) {
+	var wg sync.WaitGroup
+	for i := 0; i < numWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			worker(jobQueue, opts)
+		}()
+	}
+	wg.Wait()
+}
 
-			// 6. Check Embed Types (if any)
-			if len(rule.EmbedTypes) > 0 {
-				if event.Post == nil {
-					continue
-				}
+func worker(jobs <-chan Job, opts WorkerOptions) {
+	// Each worker has its own source so sampling doesn't contend on shared state
+	rng := rand.New(rand.NewPCG(rand.Uint64(), rand.Uint64()))
 
-				embedMatch := false
-				if event.Post.Embed != nil {
-					for _, t := range rule.EmbedTypes {
-						if t == "images" && len(event.Post.Embed.Images) > 0 {
-							embedMatch = true
-							break
-						}
-						if t == "video" && event.Post.Embed.Video != nil {
-							embedMatch = true
-							break
-						}
-						if t == "external" && event.Post.Embed.External != nil {
-							embedMatch = true
-							break
-						}
-						if t == "record" && event.Post.Embed.Record != nil {
-							embedMatch = true
-							break
-						}
-					}
-				}
+	for job := range jobs {
+		processEvent(job, opts, rng)
+	}
+}
 
-				if !embedMatch {
-					continue
-				}
+// missingPayload reports whether an event lacks the field its type is described by, such as
+// a post event with no post, which rules would otherwise see as an empty record
+func missingPayload(event *firefly.FirehoseEvent) bool {
+	switch event.Type {
+	case firefly.EventTypePost:
+		return event.Post == nil
+	case firefly.EventTypeLike:
+		return event.LikeEvent == nil
+	case firefly.EventTypeRepost:
+		return event.RepostEvent == nil
+	case firefly.EventTypeFollow:
+		return event.User == nil
+	case firefly.EventTypeDelete:
+		return event.DeleteEvent == nil
+	case firefly.EventTypeIdentity:
+		return event.IdentityEvent == nil
+	case firefly.EventTypeAccount:
+		return event.AccountEvent == nil
+	}
+	return event.RawCommit == nil || (event.RawCommit.Kind == "commit" && event.RawCommit.Commit == nil)
+}
+
+// processEvent matches a job's event against its rules and sends any match on. A panic while
+// handling the event, such as from a malformed record, is logged and counted so one bad event
+// can't take a worker down.
+func processEvent(job Job, opts WorkerOptions, rng *rand.Rand) {
+	event, rules := job.Event, job.Rules
+	if event == nil || missingPayload(event) {
+		RecordMalformedEvent()
+		return
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			RecordMalformedEvent()
+			slog.Error("Recovered from panic processing event", "panic", r, "did", event.Repo, "sequence", event.Sequence)
+			if raw, err := json.Marshal(event.RawCommit); err == nil {
+				slog.Debug("Event that caused the panic", "event", string(raw))
 			}
+		}
+	}()
 
-			// 7. Check Languages (if any)
-			if len(rule.Langs) > 0 {
-				if event.Post == nil {
-					continue
-				}
+	info := DescribeEvent(event)
+	RecordCollection(info.Collection)
+	info.Profiles = opts.Profiles
+	info.Subjects = opts.Subjects
+	info.Text = opts.Normalizer.Apply(info.Text)
 
-				langMatch := false
-				for _, postLang := range event.Post.Languages {
-					for _, ruleLang := range rule.Langs {
-						if postLang == ruleLang {
-							langMatch = true
-							break
-						}
-					}
-					if langMatch {
-						break
-					}
-				}
-				if !langMatch {
-					continue
-				}
-			}
+	// Global author gates run once per event, before any rule
+	if !opts.Filter.Permits(info) {
+		return
+	}
 
-			// 8. Check IsReply
-			if rule.IsReply != nil {
-				if event.Post == nil {
-					continue
-				}
+	// Identity events carry the current handle, so keep the cache fresh for free
+	if opts.Resolver != nil && event.IdentityEvent != nil && event.IdentityEvent.Handle != "" {
+		opts.Resolver.Store(event.IdentityEvent.DID, event.IdentityEvent.Handle)
+	}
 
-				isReply := event.Post.ReplyInfo != nil
-				if *rule.IsReply != isReply {
-					continue
-				}
-			}
+	// Sampled events log why each rule didn't match
+	debug := opts.DebugSampleRate > 0 && rng.Float64() < opts.DebugSampleRate
 
-			// Rule matched
-			matchedRules = append(matchedRules, rule.Name)
-			GlobalRuleStats.Increment(rule.Name)
+	var report func(*CompiledRuleSet, RuleResult)
+	if debug {
+		report = func(rule *CompiledRuleSet, result RuleResult) {
+			if !result.Matched {
+				slog.Debug("Rule did not match", "rule", rule.Name, "stage", result.FailedStage, "collection", info.Collection, "did", info.AuthorDID)
+			}
 		}
+	}
+	matches, matchedGroups := MatchRules(rules, info, opts.MatchDetails, report)
+	// Sampling runs before cooldowns so a sampled-out match doesn't start a cooldown
+	matches, matchedGroups = applySampling(matches, matchedGroups, info.AuthorDID, rng)
+	matches, matchedGroups = applyCooldowns(matches, matchedGroups, info.AuthorDID)
+
+	var score float64
+	for _, m := range matches {
+		score += m.Rule.Weight
+	}
+	if opts.Scoring && len(matches) > 0 && score < opts.MinScore {
+		matches, matchedGroups = nil, nil
+	}
 
-		if len(matchedRules) > 0 {
-			// Use RawCommit if available, otherwise fallback to the event itself
-			var payload interface{} = event.RawCommit
-			if payload == nil {
-				payload = event
+	var matchedRules []string
+	var details map[string]*MatchDetail
+	var templated []*CompiledRuleSet
+	var tags map[string][]string
+	var captures map[string]map[string]string
+	skewFlagged := false
+	redact := false // Any matched rule with redactText redacts the whole broadcast
+
+	for _, m := range matches {
+		rule, result := m.Rule, m.Result
+		if result.Backdated {
+			skewFlagged = true
+		}
+		matchedRules = append(matchedRules, rule.Name)
+		if rule.OutputTemplate != nil {
+			templated = append(templated, rule)
+		}
+		if rule.RedactText {
+			redact = true
+		}
+		if len(rule.Tags) > 0 {
+			if tags == nil {
+				tags = make(map[string][]string)
+			}
+			tags[rule.Name] = rule.Tags
+		}
+		if result.Captures != nil {
+			if captures == nil {
+				captures = make(map[string]map[string]string)
+			}
+			captures[rule.Name] = result.Captures
+		}
+		if result.Details != nil {
+			if details == nil {
+				details = make(map[string]*MatchDetail)
 			}
+			details[rule.Name] = result.Details
+		}
+		GlobalRuleStats.Increment(rule.Name)
+	}
 
-			msg := BroadcastMessage{
-				Event:        payload,
-				MatchedRules: matchedRules,
+	if len(matchedRules) > 0 {
+		// Use RawCommit if available, otherwise fallback to the event itself
+		var payload interface{} = event.RawCommit
+		if payload == nil {
+			payload = event
+		}
+		var redactedLength *int
+		truncated := false
+		rawFrame := job.RawFrame
+		if redact {
+			var length int
+			payload, length = redactPayload(event)
+			redactedLength = &length
+			captures = nil // Captured text would leak what was redacted
+			rawFrame = nil
+			for name, detail := range details {
+				if detail.TextMatch != "" {
+					d := *detail
+					d.TextMatch = ""
+					details[name] = &d
+				}
 			}
+		} else if opts.MaxTextBytes > 0 || opts.MaxListItems > 0 {
+			// Rules above saw the full record; only the broadcast copy is cut down
+			if record, ok := truncateRecord(event, opts.MaxTextBytes, opts.MaxListItems); ok {
+				payload = withRecord(event.RawCommit, record)
+				truncated = true
+			}
+		}
 
-			data, err := json.Marshal(msg)
-			if err != nil {
-				log.Printf("Error marshaling broadcast message: %v", err)
-				continue
+		msg := BroadcastMessage{
+			SchemaVersion: SchemaVersion,
+			Event:         payload,
+			MatchedRules:  matchedRules,
+			MatchedGroups: matchedGroups,
+			MatchDetails:  details,
+			Operation:     info.Operation,
+			AtURI:         recordURI(event),
+
+			RedactedTextLength: redactedLength,
+			Truncated:          truncated,
+			Tags:               tags,
+			Captures:           captures,
+			Replay:             time.Now().Before(opts.ReplayUntil),
+			RawFrame:           rawFrame,
+		}
+		if opts.Scoring {
+			msg.Score = &score
+		}
+		msg.AccountStatus = info.AccountStatus
+		if hours, ok := info.AuthorAgeHours(); ok {
+			msg.AuthorAgeHours = &hours
+		}
+		if event.IdentityEvent != nil {
+			msg.Identity = &IdentityChange{DID: event.IdentityEvent.DID, Handle: event.IdentityEvent.Handle}
+		}
+		msg.AuthorHandle = authorHandle(event, opts.Resolver)
+		if opts.Resolver != nil && info.TargetUserDID != "" {
+			msg.TargetHandle, _ = opts.Resolver.Lookup(info.TargetUserDID)
+		}
+		if skewFlagged {
+			if skew, ok := ClockSkew(event); ok {
+				seconds := int64(skew / time.Second)
+				msg.ClockSkewSeconds = &seconds
 			}
-			broadcast <- data
 		}
+
+		msg.info = info
+		msg.received = job.Received
+		if event.Sequence > 0 {
+			// Jetstream's time_us, when the relay emitted the event
+			msg.produced = event.Timestamp
+		}
+		msg.Rendered = renderOutputTemplates(templated, msg)
+		opts.Output.Send(msg)
 	}
 }
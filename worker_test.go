@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/TheAlyxGreen/firefly"
+	"github.com/bluesky-social/jetstream/pkg/models"
+	"github.com/gorilla/websocket"
+)
+
+// chanSink hands every match to a channel
+type chanSink chan BroadcastMessage
+
+func (s chanSink) Send(msg BroadcastMessage) {
+	s <- msg
+}
+
+// malformedFrames are Jetstream frames ParseJetstreamEvent must reject without panicking
+var malformedFrames = []string{
+	`{not json`,
+	`{"kind":"commit","time_us":1}`,
+	`{"did":"did:plc:bad","kind":"commit","time_us":2}`,
+	`{"did":"did:plc:bad","kind":"identity","time_us":3}`,
+	`{"did":"did:plc:bad","kind":"account","time_us":4}`,
+	`{"did":"did:plc:bad","kind":"commit","time_us":5,"commit":{"operation":"create","collection":"app.bsky.feed.post","rkey":"a"}}`,
+	`{"did":"did:plc:bad","kind":"commit","time_us":6,"commit":{"operation":"create","collection":"app.bsky.feed.post","rkey":"b","record":"oops"}}`,
+	`{"did":"did:plc:bad","kind":"commit","time_us":7,"commit":{"operation":"create","collection":"app.bsky.graph.follow","rkey":"c","record":[]}}`,
+}
+
+func postFrame(timeUS int, text string) string {
+	return fmt.Sprintf(`{"did":"did:plc:good","kind":"commit","time_us":%d,"commit":{"operation":"create","collection":"app.bsky.feed.post","rkey":"p","record":{"$type":"app.bsky.feed.post","text":%q,"createdAt":"2026-01-01T00:00:00Z"}}}`, timeUS, text)
+}
+
+// TestWorkerSurvivesMalformedEvents feeds events with missing fields and frames that don't
+// parse through a worker, checking it keeps matching afterwards and counts what it skipped
+func TestWorkerSurvivesMalformedEvents(t *testing.T) {
+	for _, frame := range malformedFrames {
+		if _, err := ParseJetstreamEvent(new(firefly.Firefly), []byte(frame)); err == nil {
+			t.Errorf("ParseJetstreamEvent(%s) succeeded, want an error", frame)
+		}
+	}
+
+	out := make(chanSink, 1)
+	rules := []CompiledRuleSet{{
+		Name:        "posts",
+		Collections: []string{"app.bsky.feed.post"},
+		CustomMatchers: []MatcherFunc{func(event *firefly.FirehoseEvent) bool {
+			if event.Post != nil && event.Post.Text == "boom" {
+				panic("matcher failed")
+			}
+			return true
+		}},
+	}}
+	jobs := make(chan Job, 64)
+	go worker(jobs, WorkerOptions{Filter: NewGlobalFilter(nil, nil, nil), Output: out})
+
+	before := GlobalRuleStats.Snapshot().MalformedEvents
+
+	// Events with the typed field for their type missing, as a buggy parser might produce
+	partial := []*firefly.FirehoseEvent{
+		nil,
+		{Type: firefly.EventTypePost, Repo: "did:plc:bad"},
+		{Type: firefly.EventTypeLike, Repo: "did:plc:bad"},
+		{Type: firefly.EventTypeRepost, Repo: "did:plc:bad"},
+		{Type: firefly.EventTypeFollow, Repo: "did:plc:bad"},
+		{Type: firefly.EventTypeDelete, Repo: "did:plc:bad"},
+		{Type: firefly.EventTypeIdentity, Repo: "did:plc:bad"},
+		{Type: firefly.EventTypeAccount, Repo: "did:plc:bad"},
+		{Type: firefly.EventTypeUnknown, Repo: "did:plc:bad", RawCommit: &models.Event{Did: "did:plc:bad", Kind: "commit"}},
+	}
+	for _, event := range partial {
+		jobs <- Job{Event: event, Rules: rules, Received: time.Now()}
+	}
+
+	// Then the same frames, plus one whose matcher panics, through a consumer reading a fake Jetstream
+	frames := append(append([]string{}, malformedFrames...), postFrame(8, "boom"), postFrame(9, "hello"))
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for _, frame := range frames {
+			conn.WriteMessage(websocket.TextMessage, []byte(frame))
+		}
+		<-r.Context().Done()
+	}))
+	defer srv.Close()
+
+	consumer, err := NewJetstreamConsumer(new(firefly.Firefly), JetstreamOptions{Servers: []string{"ws" + strings.TrimPrefix(srv.URL, "http")}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go consumer.Run(ctx, func(event *firefly.FirehoseEvent, _ []byte) {
+		jobs <- Job{Event: event, Rules: rules, Received: time.Now()}
+	})
+
+	select {
+	case msg := <-out:
+		if event, ok := msg.Event.(*models.Event); !ok || event.Did != "did:plc:good" {
+			t.Errorf("got match for %#v, want the valid post", msg.Event)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("worker stopped matching after malformed events")
+	}
+
+	// Every partial event, every bad frame, and the panicking matcher are each counted
+	want := int64(len(partial) + len(malformedFrames) + 1)
+	if got := GlobalRuleStats.Snapshot().MalformedEvents - before; got < want {
+		t.Errorf("malformedEvents rose by %d, want at least %d", got, want)
+	}
+}